@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+)
+
+// defaultTenant - the tenant of sessions without one
+const defaultTenant = "default"
+
+// recordTunnel - adds a finished tunnel to the stats, emits its byte-count,
+// end reason and duration metrics and writes its access log entry
+func (s *Server) recordTunnel(ctx context.Context, sess *Session, req Socks5_Req, result tunnelResult) {
+	s.stats.recordTunnel(req.FullAddr(), result)
+
+	labels := sessionLabels(sess)
+
+	ended := maps.Clone(labels)
+	ended["reason"] = result.reason
+
+	metrics := s.cfg.metrics()
+	metrics.Count(MetricBytesSent, result.sent, labels)
+	metrics.Count(MetricBytesReceived, result.received, labels)
+	metrics.Count(MetricTunnelEnded, 1, ended)
+	metrics.Observe(MetricTunnelDuration, result.duration.Seconds(), labels)
+
+	s.logger(ctx).Info("access",
+		"client", sess.ClientAddr,
+		"method", methodName(sess.Method),
+		"user", sess.User,
+		"ident", sess.Ident,
+		"tenant", sess.Tenant,
+		"egress", sess.egress,
+		"cmd", cmdName(req.Cmd),
+		"dst", req.FullAddr(),
+		"sent", result.sent,
+		"received", result.received,
+		"reason", result.reason,
+		"duration", result.duration,
+		tlsGroup(sess.TLS),
+		metadataGroup(sess.Metadata),
+	)
+}
+
+// sessionLabels - returns the metric labels of the session: its tenant, its
+// egress address and the metadata from its authenticator
+func sessionLabels(sess *Session) map[string]string {
+	labels := maps.Clone(sess.Metadata)
+	if labels == nil {
+		labels = make(map[string]string, 2)
+	}
+
+	labels["tenant"] = sess.Tenant
+	labels["egress"] = sess.egress
+	return labels
+}
+
+// egressOf - returns the egress label of an outbound connection's local
+// address: its IP, which tells the uplink the traffic left through
+func egressOf(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if v4 := tcpAddr.IP.To4(); v4 != nil {
+			return v4.String()
+		}
+
+		return tcpAddr.IP.String()
+	}
+
+	return ""
+}
+
+// tlsGroup - returns the negotiated TLS version and cipher suite of a
+// SOCKS-over-TLS session as a log group, empty for plain sessions
+func tlsGroup(state *tls.ConnectionState) slog.Attr {
+	if state == nil {
+		return slog.Group("tls")
+	}
+
+	return slog.Group("tls",
+		"version", tls.VersionName(state.Version),
+		"cipher", tls.CipherSuiteName(state.CipherSuite),
+	)
+}
+
+// metadataGroup - returns the session metadata as a log group, sorted by key
+func metadataGroup(metadata map[string]string) slog.Attr {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	attrs := make([]any, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.String(key, metadata[key]))
+	}
+
+	return slog.Group("metadata", attrs...)
+}
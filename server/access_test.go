@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// accessLines - waits for `n` access log entries and returns them
+func accessLines(t testing.TB, logs *syncBuffer, n int) []string {
+	t.Helper()
+
+	var lines []string
+	waitFor(t, "access logs", func() bool {
+		lines = lines[:0]
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "msg=access") {
+				lines = append(lines, line)
+			}
+		}
+
+		return len(lines) >= n
+	})
+
+	return lines
+}
+
+// tunnelOnce - sends a byte through the tunnel and closes it
+func tunnelOnce(t testing.TB, conn net.Conn) {
+	t.Helper()
+
+	write(t, conn, []byte{'x'})
+	readN(t, conn, 1)
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, conn)
+}
+
+func TestTenantLabelsLogsAndMetrics(t *testing.T) {
+	logger, logs := newTestLogger()
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		Logger:  logger,
+		Metrics: metrics,
+		Authenticators: []Authenticator{
+			NoAuthAuthenticator{},
+			UserPassAuthenticator{Validate: func(user, pass string) bool { return true }},
+		},
+		TenantFor: func(sess *Session) string {
+			if sess.User == "alice" {
+				return "acme"
+			}
+			return ""
+		},
+	})
+	echo := startEcho(t)
+
+	conn, _ := login(t, srv, "alice", "secret")
+	write(t, conn, ipReq(CONNECT_cmd, echo.(*net.TCPAddr)))
+	readReply(t, conn)
+	tunnelOnce(t, conn)
+
+	// no tenant falls back to the default one
+	tunnelOnce(t, connect(t, srv, echo))
+
+	lines := accessLines(t, logs, 2)
+	for _, tenant := range []string{"tenant=acme", "tenant=" + defaultTenant} {
+		if !strings.Contains(strings.Join(lines, "\n"), tenant) {
+			t.Errorf("access logs %q lack %s", lines, tenant)
+		}
+	}
+
+	for _, tenant := range []string{"acme", defaultTenant} {
+		for _, metric := range []string{MetricBytesSent, MetricBytesReceived} {
+			if got := metrics.count(metric, "tenant", tenant); got != 1 {
+				t.Errorf("%s{tenant=%s} = %d, want 1", metric, tenant, got)
+			}
+		}
+	}
+}
+
+func TestEgressInAccessLog(t *testing.T) {
+	logger, logs := newTestLogger()
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{Logger: logger, Metrics: metrics})
+
+	tunnelOnce(t, connect(t, srv, startEcho(t)))
+
+	// the loopback destination is reached from the loopback address
+	if line := accessLines(t, logs, 1)[0]; !strings.Contains(line, "egress=127.0.0.1") {
+		t.Fatalf("access log %q lacks egress=127.0.0.1", line)
+	}
+
+	if got := metrics.count(MetricTunnelEnded, "egress", "127.0.0.1"); got != 1 {
+		t.Fatalf("%s{egress=127.0.0.1} = %d, want 1", MetricTunnelEnded, got)
+	}
+}
+
+func TestAccessLogNamesTheCommand(t *testing.T) {
+	logger, logs := newTestLogger()
+	srv := startServer(t, Config{Logger: logger})
+
+	tunnelOnce(t, connect(t, srv, startEcho(t)))
+
+	if line := accessLines(t, logs, 1)[0]; !strings.Contains(line, "cmd=CONNECT") {
+		t.Fatalf("access log %q lacks cmd=CONNECT", line)
+	}
+}
+
+func TestConnIDInLogs(t *testing.T) {
+	logger, logs := newTestLogger()
+
+	var mu sync.Mutex
+	var ids []string
+	srv := startServer(t, Config{
+		Logger: logger,
+		Authorize: func(ctx context.Context, _ ClientConn, _ string, _ Socks5_Req) error {
+			mu.Lock()
+			ids = append(ids, ConnID(ctx))
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	tunnelOnce(t, connect(t, srv, startEcho(t)))
+	tunnelOnce(t, connect(t, srv, startEcho(t)))
+
+	lines := accessLines(t, logs, 2)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(ids) != 2 || len(ids[0]) == 0 || ids[0] == ids[1] {
+		t.Fatalf("connection IDs = %q, want two distinct ones", ids)
+	}
+
+	// each connection's lines carry the ID its hooks saw
+	for _, id := range ids {
+		found := false
+		for _, line := range lines {
+			found = found || strings.Contains(line, "conn_id="+id)
+		}
+
+		if !found {
+			t.Errorf("access logs %q lack conn_id=%s", lines, id)
+		}
+	}
+}
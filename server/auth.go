@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+)
+
+// Authenticator - performs the method-specific sub-negotiation for one of the
+// SOCKS5 authentication METHODs
+//
+// Any METHOD can be implemented, be it one of the named ones, an IANA
+// assigned one (X'03' to X'7F') or a private one (X'80' to X'FE'), e.g. for a
+// proprietary challenge-response scheme.
+type Authenticator interface {
+	// Method - the METHOD byte negotiated for this authenticator. X'FF' is
+	// reserved for NO ACCEPTABLE METHODS and is never selected.
+	Method() byte
+
+	// Authenticate - runs the sub-negotiation on the client connection after
+	// the METHOD selection message was sent. Returns the authenticated
+	// username, if the method has one, and optional metadata about the
+	// client (e.g. its account tier), which is stored on the Session and
+	// added to the access log and the labels of the tunnel metrics. Keep the
+	// metadata to a few keys with a bounded set of values, as each
+	// combination makes new metric series.
+	Authenticate(conn net.Conn) (user string, metadata map[string]string, err error)
+}
+
+// registerAuthenticators - keeps the first authenticator of every METHOD, in
+// order, dropping any for X'FF'
+func registerAuthenticators(auths []Authenticator) []Authenticator {
+	var registered []Authenticator
+	seen := make(map[byte]bool)
+
+	for _, auth := range auths {
+		method := auth.Method()
+		if method == NO_ACCEPTABLE_METHODS_method || seen[method] {
+			continue
+		}
+
+		seen[method] = true
+		registered = append(registered, auth)
+	}
+
+	return registered
+}
+
+// orderAuthenticators - sorts the authenticators by the position of their
+// METHOD in `preference`, those missing from it keeping their order after
+// the listed ones
+func orderAuthenticators(auths []Authenticator, preference []byte) []Authenticator {
+	rank := func(auth Authenticator) int {
+		if i := slices.Index(preference, auth.Method()); i >= 0 {
+			return i
+		}
+
+		return len(preference)
+	}
+
+	slices.SortStableFunc(auths, func(a, b Authenticator) int {
+		return rank(a) - rank(b)
+	})
+
+	return auths
+}
+
+// ErrAuthFailed - returned when the client failed the sub-negotiation
+var ErrAuthFailed = errors.New("socks5h: authentication failed")
+
+// ErrAuthBackend - returned when the credentials couldn't be verified, e.g.
+// as the credential store is unreachable. The client is refused all the same.
+var ErrAuthBackend = errors.New("socks5h: auth backend error")
+
+// NoAuthAuthenticator - X'00' NO AUTHENTICATION REQUIRED
+type NoAuthAuthenticator struct{}
+
+// Method - returns X'00'
+func (NoAuthAuthenticator) Method() byte {
+	return NO_AUTHENTICATION_REQUIRED_method
+}
+
+// Authenticate - no sub-negotiation is required
+func (NoAuthAuthenticator) Authenticate(conn net.Conn) (string, map[string]string, error) {
+	return "", nil, nil
+}
+
+// UserPassAuthenticator - X'02' USERNAME/PASSWORD authentication.
+// Follows the guidelines of - https://datatracker.ietf.org/doc/html/rfc1929
+type UserPassAuthenticator struct {
+	// Validate - reports whether the given credentials are valid
+	Validate func(user, pass string) bool
+
+	// Check - verifies the given credentials, used instead of Validate if
+	// set. Returns nil if they're valid, an error wrapping ErrAuthFailed if
+	// they're not and any other error if they couldn't be verified, e.g. as
+	// the credential store is unreachable. A panic counts as the latter.
+	Check func(user, pass string) error
+
+	// BackendErrorStatus - the STATUS sent when Check fails with anything but
+	// ErrAuthFailed. Zero sends X'01' failure, as for bad credentials.
+	BackendErrorStatus byte
+}
+
+// Method - returns X'02'
+func (UserPassAuthenticator) Method() byte {
+	return USERNAME_PASSWORD_method
+}
+
+// Authenticate - the client sends the username/password request:
+//
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+----+------+----------+------+----------+
+//
+// The VER field contains the current version of the subnegotiation, which
+// is X'01'. The server verifies the supplied UNAME and PASSWD, and sends
+// the following response:
+//
+//	+----+--------+
+//	|VER | STATUS |
+//	+----+--------+
+//	| 1  |   1    |
+//	+----+--------+
+//
+// A STATUS field of X'00' indicates success. If the server returns a
+// `failure' (STATUS value other than X'00') status, it MUST close the
+// connection.
+func (a UserPassAuthenticator) Authenticate(conn net.Conn) (string, map[string]string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", nil, err
+	}
+
+	if header[0] != USERNAME_PASSWORD_VERSION {
+		return "", nil, fmt.Errorf("%w: invalid username/password sub-negotiation version", ErrAuthFailed)
+	}
+
+	uname := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return "", nil, err
+	}
+
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return "", nil, err
+	}
+
+	passwd := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return "", nil, err
+	}
+
+	user := string(uname)
+	checkErr := a.check(user, string(passwd))
+
+	status := byte(USERNAME_PASSWORD_SUCCESS_status)
+	switch {
+	case checkErr == nil:
+	case errors.Is(checkErr, ErrAuthFailed) || a.BackendErrorStatus == USERNAME_PASSWORD_SUCCESS_status:
+		status = USERNAME_PASSWORD_FAILURE_status
+	default:
+		status = a.BackendErrorStatus
+	}
+
+	if _, err := conn.Write([]byte{USERNAME_PASSWORD_VERSION, status}); err != nil {
+		return "", nil, err
+	}
+
+	if checkErr != nil {
+		return "", nil, checkErr
+	}
+
+	return user, nil, nil
+}
+
+// check - verifies the credentials with Check, or else Validate. Returns
+// ErrAuthFailed for bad credentials and ErrAuthBackend, wrapping the cause,
+// when they couldn't be verified.
+func (a UserPassAuthenticator) check(user, pass string) (err error) {
+	if a.Check == nil {
+		if a.Validate != nil && a.Validate(user, pass) {
+			return nil
+		}
+
+		return ErrAuthFailed
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: panic: %v", ErrAuthBackend, r)
+		}
+	}()
+
+	if err := a.Check(user, pass); err != nil {
+		if errors.Is(err, ErrAuthFailed) {
+			return err
+		}
+
+		return fmt.Errorf("%w: %w", ErrAuthBackend, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// userPassMsg - encodes a username/password request
+func userPassMsg(user, pass string) []byte {
+	msg := []byte{USERNAME_PASSWORD_VERSION, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	return append(msg, pass...)
+}
+
+// login - connects to the server and authenticates as `user`, returning the
+// STATUS of the sub-negotiation
+func login(t *testing.T, srv *Server, user, pass string) (net.Conn, byte) {
+	t.Helper()
+
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, USERNAME_PASSWORD_method})
+
+	if got := readN(t, conn, 2); got[1] != USERNAME_PASSWORD_method {
+		t.Fatalf("selected %s, want username/password", methodName(got[1]))
+	}
+
+	write(t, conn, userPassMsg(user, pass))
+	return conn, readN(t, conn, 2)[1]
+}
+
+func TestBadCredentials(t *testing.T) {
+	srv := startServer(t, Config{
+		Authenticators: []Authenticator{UserPassAuthenticator{
+			Validate: func(user, pass string) bool { return pass == "secret" },
+		}},
+	})
+
+	if _, status := login(t, srv, "alice", "guess"); status != USERNAME_PASSWORD_FAILURE_status {
+		t.Fatalf("auth status = %d, want failure", status)
+	}
+}
+
+func TestAuthorizeSeesUserAndRepliesRuleset(t *testing.T) {
+	echo := startEcho(t)
+
+	var mu sync.Mutex
+	var users []string
+
+	srv := startServer(t, Config{
+		Authenticators: []Authenticator{UserPassAuthenticator{
+			Validate: func(user, pass string) bool { return pass == "secret" },
+		}},
+		Authorize: func(ctx context.Context, client ClientConn, user string, req Socks5_Req) error {
+			mu.Lock()
+			users = append(users, user)
+			mu.Unlock()
+
+			if user == "mallory" {
+				return errors.New("mallory may not connect")
+			}
+
+			return nil
+		},
+	})
+
+	for _, tc := range []struct {
+		user string
+		want byte
+	}{
+		{"alice", SUCCEEDED_connReply},
+		{"mallory", CONNECTION_NOT_ALLOWED_BY_RULESET_connReply},
+	} {
+		conn, status := login(t, srv, tc.user, "secret")
+		if status != USERNAME_PASSWORD_SUCCESS_status {
+			t.Fatalf("%s: auth status = %d", tc.user, status)
+		}
+
+		write(t, conn, ipReq(CONNECT_cmd, echo.(*net.TCPAddr)))
+		if reply := readReply(t, conn); reply.rep != tc.want {
+			t.Fatalf("%s: reply = %s, want %s", tc.user, replyName(reply.rep), replyName(tc.want))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if strings.Join(users, ",") != "alice,mallory" {
+		t.Fatalf("Authorize saw users %q, want alice and mallory", users)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	srv := startServer(t, Config{
+		AuthTimeout: 50 * time.Millisecond,
+		Authenticators: []Authenticator{UserPassAuthenticator{
+			Validate: func(user, pass string) bool { return true },
+		}},
+	})
+
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, USERNAME_PASSWORD_method})
+	readN(t, conn, 2)
+
+	// a username that never completes
+	write(t, conn, []byte{USERNAME_PASSWORD_VERSION, 3, 'a'})
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("stalled sub-negotiation wasn't closed")
+	}
+}
+
+// metadataAuthenticator - a private method returning session metadata
+type metadataAuthenticator struct{}
+
+func (metadataAuthenticator) Method() byte {
+	return 0x80
+}
+
+func (metadataAuthenticator) Authenticate(conn net.Conn) (string, map[string]string, error) {
+	return "device", map[string]string{"tier": "gold"}, nil
+}
+
+func TestAuthenticatorMetadataLabelsMetrics(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{Metrics: metrics, Authenticators: []Authenticator{metadataAuthenticator{}}})
+
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, 0x80})
+	readN(t, conn, 2)
+
+	write(t, conn, ipReq(CONNECT_cmd, startEcho(t).(*net.TCPAddr)))
+	readReply(t, conn)
+	conn.Close()
+
+	waitFor(t, "tunnel labeled by metadata", func() bool {
+		return metrics.count(MetricTunnelEnded, "tier", "gold") == 1
+	})
+}
+
+func TestAuthBackendErrorStatus(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		Metrics: metrics,
+		Authenticators: []Authenticator{UserPassAuthenticator{
+			Check:              func(user, pass string) error { return errors.New("credential store down") },
+			BackendErrorStatus: 0x05,
+		}},
+	})
+
+	if _, status := login(t, srv, "alice", "secret"); status != 0x05 {
+		t.Fatalf("auth status = %d, want the backend error status 5", status)
+	}
+
+	waitFor(t, "auth_backend_error", func() bool {
+		return metrics.count(MetricHandshakeFailed, "reason", "auth_backend_error") == 1
+	})
+}
+
+func TestPipelinedAuthentication(t *testing.T) {
+	echo := startEcho(t)
+	srv := startServer(t, Config{
+		Authenticators: []Authenticator{UserPassAuthenticator{
+			Validate: func(user, pass string) bool { return true },
+		}},
+	})
+
+	conn := dialServer(t, srv)
+
+	msg := []byte{SOCKS5H_VERSION, 1, USERNAME_PASSWORD_method}
+	msg = append(msg, userPassMsg("a", "b")...)
+	msg = append(msg, ipReq(CONNECT_cmd, echo.(*net.TCPAddr))...)
+	write(t, conn, append(msg, "ping"...))
+
+	if got := readN(t, conn, 4); !bytes.Equal(got, []byte{SOCKS5H_VERSION, USERNAME_PASSWORD_method, USERNAME_PASSWORD_VERSION, USERNAME_PASSWORD_SUCCESS_status}) {
+		t.Fatalf("negotiation = %v", got)
+	}
+
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("reply = %s", replyName(reply.rep))
+	}
+
+	if got := readN(t, conn, 4); string(got) != "ping" {
+		t.Fatalf("echo = %q, want ping", got)
+	}
+}
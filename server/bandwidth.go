@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter - a pair of token buckets, upload and download, per
+// client IP, shared by all the tunnels of the client, see
+// `Config.ClientBandwidth`
+type bandwidthLimiter struct {
+	rate float64
+
+	mu      sync.Mutex
+	clients map[string]*clientBandwidth
+}
+
+// clientBandwidth - the buckets of a client IP, kept while it has tunnels
+type clientBandwidth struct {
+	up   bandwidthBucket
+	down bandwidthBucket
+
+	// tunnels - the open tunnels of the client
+	tunnels int
+}
+
+// bandwidthBucket - the bytes a client may still relay in one direction as
+// of `last`, going negative as reads reserve the bytes they got
+type bandwidthBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter - creates a limiter letting each client IP relay
+// `rate` bytes per second in either direction. Returns nil, limiting
+// nothing, if `rate` isn't positive.
+func newBandwidthLimiter(rate int) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &bandwidthLimiter{
+		rate:    float64(rate),
+		clients: make(map[string]*clientBandwidth),
+	}
+}
+
+// limit - wraps the client connection of a tunnel so that its reads and
+// writes draw from the buckets of its IP. The returned func must be called
+// once the tunnel is done.
+func (l *bandwidthLimiter) limit(client net.Conn) (net.Conn, func()) {
+	if l == nil {
+		return client, func() {}
+	}
+
+	ip := addrIP(client.RemoteAddr()).String()
+
+	l.mu.Lock()
+	cb, ok := l.clients[ip]
+	if !ok {
+		now := time.Now()
+		cb = &clientBandwidth{
+			up:   bandwidthBucket{tokens: l.rate, last: now},
+			down: bandwidthBucket{tokens: l.rate, last: now},
+		}
+		l.clients[ip] = cb
+	}
+	cb.tunnels++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if cb.tunnels--; cb.tunnels == 0 {
+			delete(l.clients, ip)
+		}
+	}
+
+	return &throttledConn{wrappedConn: wrappedConn{client}, limiter: l, bandwidth: cb}, release
+}
+
+// wait - takes `n` bytes from the bucket, sleeping until the bucket has
+// refilled enough if it runs short
+func (b *bandwidthBucket) wait(n int, rate float64) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / rate * float64(time.Second)))
+	}
+}
+
+// throttledConn - a client connection whose reads (uploads) and writes
+// (downloads) are paced by the bandwidth of its client IP
+type throttledConn struct {
+	wrappedConn
+
+	limiter   *bandwidthLimiter
+	bandwidth *clientBandwidth
+}
+
+func (t *throttledConn) Read(p []byte) (int, error) {
+	// reading at most a second's worth keeps the waits short
+	if limit := int(t.limiter.rate); len(p) > limit {
+		p = p[:limit]
+	}
+
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.bandwidth.up.wait(n, t.limiter.rate)
+	}
+
+	return n, err
+}
+
+func (t *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	limit := int(t.limiter.rate)
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), limit)]
+		t.bandwidth.down.wait(len(chunk), t.limiter.rate)
+
+		n, err := t.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
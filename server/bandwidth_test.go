@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientBandwidth(t *testing.T) {
+	const rate = 32 * 1024
+
+	srv := startServer(t, Config{ClientBandwidth: rate})
+	conn := connect(t, srv, startEcho(t))
+
+	// a full bucket, then half a second's worth more
+	payload := make([]byte, rate+rate/2)
+	start := time.Now()
+
+	go func() {
+		conn.Write(payload)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil || n != int64(len(payload)) {
+		t.Fatalf("echoed %d bytes, %v, want %d", n, err, len(payload))
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("relayed %d bytes in %s, faster than %d bytes/s allows", n, elapsed, rate)
+	}
+}
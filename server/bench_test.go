@@ -0,0 +1,204 @@
+package server
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// replayConn - a connection whose reads return `msg`, counting the reads made
+// as a stand-in for read syscalls
+type replayConn struct {
+	net.Conn
+	msg   []byte
+	reads int
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	c.reads++
+	if len(c.msg) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, c.msg)
+	c.msg = c.msg[n:]
+	return n, nil
+}
+
+// readHandshake - reads the version identifier/method selection message and
+// the request off `conn` as the server does
+func readHandshake(b *testing.B, conn net.Conn, scratch []byte) {
+	if _, err := io.ReadFull(conn, scratch[:1]); err != nil {
+		b.Fatal(err)
+	}
+
+	if _, err := readMethods(conn, scratch); err != nil {
+		b.Fatal(err)
+	}
+
+	if _, err := readSockRequest(conn, scratch, nil); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkHandshakeReads(b *testing.B) {
+	msg := []byte{SOCKS5H_VERSION, 2, NO_AUTHENTICATION_REQUIRED_method, USERNAME_PASSWORD_method}
+	msg = append(msg, domainReq(CONNECT_cmd, "example.com", 443)...)
+
+	for _, buffered := range []bool{false, true} {
+		name := "unbuffered"
+		if buffered {
+			name = "buffered"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			var scratch [handshakeScratchSize]byte
+			reads := 0
+
+			for range b.N {
+				raw := &replayConn{msg: msg}
+
+				var conn net.Conn = raw
+				if buffered {
+					conn = newBufferedConn(raw, 0)
+				}
+
+				readHandshake(b, conn, scratch[:])
+				reads += raw.reads
+			}
+
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// benchCopy - measures `copy` relaying b.N chunks of 32KB from one loopback
+// TCP connection to another
+func benchCopy(b *testing.B, copy func(dst, src net.Conn) (int64, error)) {
+	srcPeer, src := tcpPair(b)
+	dst, dstPeer := tcpPair(b)
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+
+	go func() {
+		for range b.N {
+			if _, err := srcPeer.Write(chunk); err != nil {
+				return
+			}
+		}
+		srcPeer.CloseWrite()
+	}()
+
+	drained := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, dstPeer)
+		drained <- n
+	}()
+
+	b.ResetTimer()
+
+	n, err := copy(dst, src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst.CloseWrite()
+
+	if want := int64(b.N * len(chunk)); n != want || <-drained != want {
+		b.Fatalf("copied %d bytes, want %d", n, want)
+	}
+}
+
+func BenchmarkCopyStream(b *testing.B) {
+	kinds := []struct {
+		name string
+		kind StreamKind
+	}{
+		{"default", StreamDefault},
+		{"interactive", StreamInteractive},
+		{"bulk", StreamBulk},
+	}
+
+	for _, kind := range kinds {
+		// raw TCP connections are spliced, except for interactive streams,
+		// while wrapped ones go through the copy buffers
+		b.Run(kind.name+"/tcp", func(b *testing.B) {
+			benchCopy(b, func(dst, src net.Conn) (int64, error) {
+				return copyStream(dst, src, nil, kind.kind)
+			})
+		})
+
+		b.Run(kind.name+"/wrapped", func(b *testing.B) {
+			benchCopy(b, func(dst, src net.Conn) (int64, error) {
+				return copyStream(struct{ net.Conn }{dst}, struct{ net.Conn }{src}, nil, kind.kind)
+			})
+		})
+	}
+}
+
+func BenchmarkSplice(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		if runtime.GOOS != "linux" {
+			b.Skip("splice is only used on Linux")
+		}
+
+		benchCopy(b, func(dst, src net.Conn) (int64, error) {
+			n, _, err := spliceStream(dst, src, nil)
+			return n, err
+		})
+	})
+
+	b.Run("io.Copy", func(b *testing.B) {
+		benchCopy(b, func(dst, src net.Conn) (int64, error) {
+			// hide ReadFrom/WriteTo, which would splice as well
+			return io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+		})
+	})
+}
+
+func BenchmarkHandshakeScratch(b *testing.B) {
+	// the largest handshake: 255 methods and a 255 bytes domain name
+	msg := []byte{SOCKS5H_VERSION, 255}
+	msg = append(msg, make([]byte, 255)...)
+	msg = append(msg, domainReq(CONNECT_cmd, strings.Repeat("a", 255), 443)...)
+
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+
+		var scratch [handshakeScratchSize]byte
+		for range b.N {
+			readHandshake(b, &replayConn{msg: msg}, scratch[:])
+		}
+	})
+
+	b.Run("per handshake", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for range b.N {
+			readHandshake(b, &replayConn{msg: msg}, make([]byte, handshakeScratchSize))
+		}
+	})
+}
+
+func BenchmarkResEncode(b *testing.B) {
+	for _, res := range []Socks5_Res{
+		{Reply: SUCCEEDED_connReply, AType: IP_V4_addr, BindAddr: "192.0.2.1", BindPort: 1080},
+		{Reply: SUCCEEDED_connReply, AType: IP_V6_addr, BindAddr: "2001:db8::1", BindPort: 1080},
+		newFailureRes(HOST_UNREACHABLE_connReply),
+	} {
+		b.Run(res.BindAddr, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for range b.N {
+				if _, err := res.Encode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
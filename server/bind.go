@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// bindDst - handles the BIND request. BIND is used in protocols which require
+// the client to accept connections from the server (e.g. FTP).
+//
+// Two replies are sent from the SOCKS server to the client during a BIND
+// operation. The first is sent after the server creates and binds a new
+// socket. The BND.PORT field contains the port number that the SOCKS server
+// assigned to listen for an incoming connection. The BND.ADDR field contains
+// the associated IP address.
+//
+// The second reply occurs only after the anticipated incoming connection
+// succeeds or fails. In the second reply, the BND.PORT and BND.ADDR fields
+// contain the address and port number of the connecting host.
+//
+// The first reply is written here, while the second one is returned to be
+// sent by the caller along with the accepted connection. Without an incoming
+// connection within `Config.BindTimeout`, or the grace period returned by
+// `Config.BindTimeoutFor`, the second reply is TTL_EXPIRED.
+//
+// DST.ADDR is the address of the host expected to connect, a domain name
+// being resolved. Connections from other addresses are closed and waiting
+// goes on, unless DST.ADDR is unspecified (0.0.0.0 or ::) in which case the
+// first incoming connection is accepted. DST.PORT isn't checked, as the
+// host connects from a port of its choosing.
+func (s *Server) bindDst(ctx context.Context, conn net.Conn, sess *Session, req Socks5_Req) (net.Conn, Socks5_Res, error) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("control connection isn't tcp")
+	}
+
+	if !s.bindSlots.acquire() {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("too many bind listeners")
+	}
+	defer s.bindSlots.release()
+
+	expected, err := s.bindPeers(ctx, req)
+	if err != nil {
+		return nil, newFailureRes(HOST_UNREACHABLE_connReply), err
+	}
+
+	bindAddr := &net.TCPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+	if s.cfg.BindIP != nil {
+		bindAddr = &net.TCPAddr{IP: s.cfg.BindIP}
+	}
+
+	listener, err := s.listenBind(bindAddr)
+	if err != nil {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), err
+	}
+	defer listener.Close()
+
+	if err := s.reply(conn, sess, newBindRes(listener.Addr())); err != nil {
+		return nil, sentRes(), err
+	}
+
+	timeout := s.cfg.bindTimeout(req)
+	if timeout > 0 {
+		if err := listener.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), err
+		}
+	}
+
+	for {
+		peer, err := acceptWhileConnected(conn, listener)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, newFailureRes(TTL_EXPIRED_connReply), fmt.Errorf("no incoming connection within %s: %w", timeout, err)
+		}
+
+		if err != nil {
+			return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), err
+		}
+
+		if bindPeerExpected(peer, expected) {
+			return peer, newBindRes(peer.RemoteAddr()), nil
+		}
+
+		s.logger(ctx).Warn("unexpected BIND peer", "peer", peer.RemoteAddr(), "dst", req.AddrStr())
+		peer.Close()
+	}
+}
+
+// bindPeers - returns the IPs the incoming connection of a BIND request may
+// come from, resolving a DST.ADDR domain name. Nil means any, for an
+// unspecified DST.ADDR.
+func (s *Server) bindPeers(ctx context.Context, req Socks5_Req) ([]netip.Addr, error) {
+	if req.AType != DOMAINNAME_addr {
+		ip, ok := netip.AddrFromSlice(req.DstAddr)
+		if !ok {
+			return nil, fmt.Errorf("invalid BIND address %v", req.DstAddr)
+		}
+
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+
+	if timeout := s.cfg.dialTimeout(req); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	addrs, err := s.lookupHost(ctx, req.AddrStr())
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []netip.Addr
+	for _, addr := range addrs {
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s resolves to no IPs", req.AddrStr())
+	}
+
+	return ips, nil
+}
+
+// bindPeerExpected - tells whether the incoming connection comes from one of
+// the `expected` IPs, any IP being expected when nil
+func bindPeerExpected(peer net.Conn, expected []netip.Addr) bool {
+	if expected == nil {
+		return true
+	}
+
+	addr, ok := peer.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return slices.Contains(expected, addr.AddrPort().Addr().Unmap().WithZone(""))
+}
+
+// listenBind - creates the BIND listener on `addr`. The port is picked by
+// `Config.PortAllocator` if set. Otherwise, with a port range configured,
+// the ports of the range are tried from a random one onwards until one is
+// free.
+func (s *Server) listenBind(addr *net.TCPAddr) (*net.TCPListener, error) {
+	if s.cfg.PortAllocator != nil {
+		port, err := s.cfg.PortAllocator()
+		if err != nil {
+			return nil, fmt.Errorf("allocating port: %w", err)
+		}
+
+		return net.ListenTCP(s.cfg.bindNetwork(), &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+	}
+
+	lo, hi := s.cfg.BindPortMin, s.cfg.BindPortMax
+	if lo <= 0 || hi < lo {
+		return net.ListenTCP(s.cfg.bindNetwork(), addr)
+	}
+
+	size := hi - lo + 1
+	first := rand.IntN(size)
+
+	for i := range size {
+		port := lo + (first+i)%size
+
+		listener, err := net.ListenTCP(s.cfg.bindNetwork(), &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+		if err == nil {
+			return listener, nil
+		}
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no free port in bind range %d-%d", lo, hi)
+}
+
+// acceptWhileConnected - accepts the incoming connection on the BIND listener.
+// The client is watched meanwhile and a disconnect releases the listener.
+// Bytes the client pipelined ahead of the second reply are kept for the
+// tunnel while the watch goes on; a client pipelining more than the
+// handshake buffer holds ends the BIND.
+func acceptWhileConnected(conn net.Conn, listener net.Listener) (net.Conn, error) {
+	watched := make(chan struct{})
+
+	go func() {
+		defer close(watched)
+
+		if bc, ok := conn.(*bufferedConn); ok {
+			if err := bc.awaitClose(); !errors.Is(err, os.ErrDeadlineExceeded) {
+				listener.Close()
+			}
+
+			return
+		}
+
+		// a byte read off a plain connection would be lost, so the client
+		// sending anything ends the BIND too
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			listener.Close()
+		}
+	}()
+
+	peer, err := listener.Accept()
+
+	// stop watching before the connection is handed to the tunnel
+	conn.SetReadDeadline(time.Now())
+	<-watched
+	conn.SetReadDeadline(time.Time{})
+
+	return peer, err
+}
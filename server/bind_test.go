@@ -0,0 +1,256 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bind - negotiates and sends a BIND request expecting a connection from
+// `peer`, returning the address the server listens on
+func bind(t *testing.T, srv *Server, peer *net.TCPAddr) (net.Conn, *net.TCPAddr) {
+	t.Helper()
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(BIND_cmd, peer))
+
+	first := readReply(t, conn)
+	if first.rep != SUCCEEDED_connReply {
+		t.Fatalf("first BIND reply = %s", replyName(first.rep))
+	}
+
+	return conn, &net.TCPAddr{IP: net.ParseIP(first.addr), Port: first.port}
+}
+
+func TestBindRejectsUnexpectedPeer(t *testing.T) {
+	srv := startServer(t, Config{})
+	conn, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)})
+
+	// connecting from 127.0.0.1 rather than the requested 127.0.0.2
+	stray, err := net.Dial("tcp4", listenAddr.String())
+	if err != nil {
+		t.Fatalf("dialing the BIND listener: %v", err)
+	}
+	defer stray.Close()
+
+	stray.SetReadDeadline(time.Now().Add(testTimeout))
+	if n, err := stray.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("unexpected peer read %d bytes, want it closed", n)
+	}
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	peer, err := dialer.Dial("tcp4", listenAddr.String())
+	if err != nil {
+		t.Skipf("dialing from 127.0.0.2: %v", err)
+	}
+	defer peer.Close()
+
+	second := readReply(t, conn)
+	if second.rep != SUCCEEDED_connReply || second.addr != "127.0.0.2" {
+		t.Fatalf("second BIND reply = %s from %s, want succeeded from 127.0.0.2", replyName(second.rep), second.addr)
+	}
+}
+
+func TestBindResolvesExpectedPeer(t *testing.T) {
+	srv := startServer(t, Config{Resolver: &staticResolver{addrs: []string{"127.0.0.1"}}})
+
+	conn := negotiate(t, srv)
+	write(t, conn, domainReq(BIND_cmd, "ftp.example", 21))
+
+	first := readReply(t, conn)
+	if first.rep != SUCCEEDED_connReply {
+		t.Fatalf("first BIND reply = %s", replyName(first.rep))
+	}
+
+	peer, err := net.Dial("tcp4", net.JoinHostPort(first.addr, strconv.Itoa(first.port)))
+	if err != nil {
+		t.Fatalf("dialing the BIND listener: %v", err)
+	}
+	defer peer.Close()
+
+	if second := readReply(t, conn); second.rep != SUCCEEDED_connReply {
+		t.Fatalf("second BIND reply = %s", replyName(second.rep))
+	}
+}
+
+func TestBindSecondReplyReportsPeer(t *testing.T) {
+	srv := startServer(t, Config{})
+	conn, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	peer, err := net.Dial("tcp4", listenAddr.String())
+	if err != nil {
+		t.Fatalf("dialing the BIND listener: %v", err)
+	}
+	defer peer.Close()
+
+	second := readReply(t, conn)
+	if second.rep != SUCCEEDED_connReply {
+		t.Fatalf("second BIND reply = %s", replyName(second.rep))
+	}
+
+	if got := net.JoinHostPort(second.addr, strconv.Itoa(second.port)); got != peer.LocalAddr().String() {
+		t.Fatalf("second reply reports %s, want the peer %s", got, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("220 ready"))
+	if got := readN(t, conn, 9); string(got) != "220 ready" {
+		t.Fatalf("tunneled %q, want the peer's greeting", got)
+	}
+}
+
+func TestBindNetwork(t *testing.T) {
+	requireIPv6(t)
+
+	srv := startServer(t, Config{Addr: "[::1]:0", BindNetwork: TCP_V6})
+	_, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv6unspecified})
+
+	if listenAddr.IP.To4() != nil {
+		t.Fatalf("BIND listens on %s, want an IPv6 address", listenAddr)
+	}
+
+	// a network the listener can't be opened on fails the BIND
+	srv = startServer(t, Config{BindNetwork: "tcp5"})
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(BIND_cmd, &net.TCPAddr{IP: net.IPv4zero}))
+
+	if reply := readReply(t, conn); reply.rep != GENERAL_SOCKS_SERVER_FAILURE_connReply {
+		t.Fatalf("BIND reply with an invalid network = %s, want general failure", replyName(reply.rep))
+	}
+}
+
+func TestBindPortRange(t *testing.T) {
+	srv := startServer(t, Config{BindPortMin: 41000, BindPortMax: 41009})
+	_, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if listenAddr.Port < 41000 || listenAddr.Port > 41009 {
+		t.Fatalf("BIND listens on port %d, outside of 41000-41009", listenAddr.Port)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	srv := startServer(t, Config{BindTimeout: 50 * time.Millisecond})
+	conn, _ := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if second := readReply(t, conn); second.rep != TTL_EXPIRED_connReply {
+		t.Fatalf("second BIND reply = %s, want TTL expired", replyName(second.rep))
+	}
+}
+
+func TestBindPortAllocator(t *testing.T) {
+	// a port known to be free
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	free := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	errExhausted := errors.New("pool exhausted")
+	var calls atomic.Int32
+	srv := startServer(t, Config{
+		// the allocator takes precedence over the range
+		BindPortMin: 41000,
+		BindPortMax: 41009,
+		PortAllocator: func() (int, error) {
+			if calls.Add(1) > 1 {
+				return 0, errExhausted
+			}
+			return free, nil
+		},
+	})
+
+	if _, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}); listenAddr.Port != free {
+		t.Fatalf("BIND listens on port %d, want the allocated %d", listenAddr.Port, free)
+	}
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(BIND_cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if reply := readReply(t, conn); reply.rep != GENERAL_SOCKS_SERVER_FAILURE_connReply {
+		t.Fatalf("reply once the pool is exhausted = %s, want general failure", replyName(reply.rep))
+	}
+}
+
+func TestBindTimeoutFor(t *testing.T) {
+	srv := startServer(t, Config{
+		BindTimeout: time.Minute,
+		BindTimeoutFor: func(req Socks5_Req) time.Duration {
+			if req.PortNum() == 21 {
+				return 50 * time.Millisecond
+			}
+			return 0
+		},
+	})
+
+	// the override expires its BIND
+	start := time.Now()
+	conn, _ := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21})
+	if second := readReply(t, conn); second.rep != TTL_EXPIRED_connReply {
+		t.Fatalf("second BIND reply = %s, want TTL expired", replyName(second.rep))
+	}
+
+	if waited := time.Since(start); waited > 10*time.Second {
+		t.Fatalf("BIND expired after %v, want the 50ms override", waited)
+	}
+
+	// the others keep BindTimeout and still get their peer
+	conn, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20})
+	time.Sleep(100 * time.Millisecond)
+
+	peer, err := net.Dial("tcp4", listenAddr.String())
+	if err != nil {
+		t.Fatalf("dialing the BIND listener: %v", err)
+	}
+	defer peer.Close()
+
+	if second := readReply(t, conn); second.rep != SUCCEEDED_connReply {
+		t.Fatalf("second BIND reply = %s, want succeeded", replyName(second.rep))
+	}
+}
+
+func TestBindKeepsPipelinedBytes(t *testing.T) {
+	srv := startServer(t, Config{})
+	conn, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	// sent ahead of the second reply
+	write(t, conn, []byte("early"))
+	time.Sleep(20 * time.Millisecond)
+
+	peer, err := net.Dial("tcp4", listenAddr.String())
+	if err != nil {
+		t.Fatalf("dialing the BIND listener: %v", err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(testTimeout))
+
+	if second := readReply(t, conn); second.rep != SUCCEEDED_connReply {
+		t.Fatalf("second BIND reply = %s", replyName(second.rep))
+	}
+
+	if got := readN(t, peer, 5); string(got) != "early" {
+		t.Fatalf("peer got %q, want the pipelined bytes", got)
+	}
+}
+
+func TestBindReleasedWhenPipeliningClientLeaves(t *testing.T) {
+	srv := startServer(t, Config{})
+
+	// probing from 127.0.0.1 then never completes the BIND
+	conn, listenAddr := bind(t, srv, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)})
+
+	// the client pipelines a byte then leaves, with no BindTimeout
+	write(t, conn, []byte("x"))
+	conn.Close()
+
+	waitFor(t, "BIND listener released", func() bool {
+		peer, err := net.Dial("tcp4", listenAddr.String())
+		if err != nil {
+			return true
+		}
+
+		peer.Close()
+		return false
+	})
+}
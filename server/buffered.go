@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// handshakeBufferSize - the read buffer of client connections, large enough
+// for the whole handshake of a well-behaved client
+const handshakeBufferSize = 1024
+
+// bufferedConn - a client connection read through a bufio.Reader, so that the
+// many small reads of the handshake don't each cost a syscall. Bytes buffered
+// past the handshake are returned by the following reads.
+//
+// While `limit` is set, reads past `limit` bytes in total fail with
+// ErrHandshakeTooLarge.
+type bufferedConn struct {
+	wrappedConn
+	r *bufio.Reader
+
+	consumed int
+	limit    int
+}
+
+// newBufferedConn - starts buffering reads from the connection, allowing up to
+// `limit` bytes to be read until the limit is lifted. Zero means no limit.
+func newBufferedConn(conn net.Conn, limit int) *bufferedConn {
+	return &bufferedConn{
+		wrappedConn: wrappedConn{conn},
+		r:           bufio.NewReaderSize(conn, handshakeBufferSize),
+		limit:       limit,
+	}
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	if b.limit > 0 {
+		if b.consumed >= b.limit {
+			return 0, ErrHandshakeTooLarge
+		}
+
+		p = p[:min(len(p), b.limit-b.consumed)]
+	}
+
+	n, err := b.r.Read(p)
+	b.consumed += n
+	return n, err
+}
+
+// liftLimit - allows unlimited reads once the handshake is over
+func (b *bufferedConn) liftLimit() {
+	b.limit = 0
+}
+
+// awaitClose - blocks until reading fails, e.g. as the client closed the
+// connection, without consuming anything, so that bytes a client pipelined
+// meanwhile are kept for the tunnel. Fails with bufio.ErrBufferFull once the
+// client pipelined more than the buffer holds, as watching it further would
+// mean dropping bytes.
+func (b *bufferedConn) awaitClose() error {
+	for {
+		if _, err := b.r.Peek(b.r.Buffered() + 1); err != nil {
+			return err
+		}
+	}
+}
+
+// buffered - returns the bytes read off the connection but not consumed yet,
+// without blocking
+func (b *bufferedConn) buffered() []byte {
+	pending, _ := b.r.Peek(b.r.Buffered())
+	return pending
+}
+
+// detach - returns the underlying connection, to be read directly from now
+// on. Bytes buffered past the handshake, which a client may have pipelined
+// right after its request (e.g. a TLS ClientHello), are returned by its
+// first reads, so that they go through whatever wraps the connection next.
+// Once they're read the tunnel uses the fast paths of the raw connection.
+func (b *bufferedConn) detach() net.Conn {
+	n := b.r.Buffered()
+	if n == 0 {
+		return b.Conn
+	}
+
+	// the reader isn't read from anymore, so its buffer can be handed over
+	pending, _ := b.r.Peek(n)
+	return &prefixConn{wrappedConn: b.wrappedConn, prefix: pending}
+}
+
+// wrappedConn - embedded by the connections wrapping another one, giving
+// them the NetConn that findConn walks down and a CloseWrite
+type wrappedConn struct {
+	net.Conn
+}
+
+// NetConn - returns the underlying connection
+func (w wrappedConn) NetConn() net.Conn {
+	return w.Conn
+}
+
+// CloseWrite - half-closes the underlying connection. If it can't be
+// half-closed it's left open and errors.ErrUnsupported is returned, the
+// caller deciding whether to close it instead.
+func (w wrappedConn) CloseWrite() error {
+	if cw, ok := w.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return fmt.Errorf("%w: %T can't be half-closed", errors.ErrUnsupported, w.Conn)
+}
+
+// findConn - walks down the chain of wrapped connections and returns the first
+// one of type T
+func findConn[T any](conn net.Conn) (T, bool) {
+	for {
+		if found, ok := conn.(T); ok {
+			return found, true
+		}
+
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+
+		conn = wrapped.NetConn()
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ClientConn - the limited view of the client connection handed to hooks.
+//
+// Hooks may inspect the addresses and the TLS state, set deadlines or apply
+// socket options through SyscallConn (e.g. SO_MARK), but they must never
+// read from or write to the connection as that would corrupt the SOCKS
+// exchange.
+type ClientConn interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetDeadline(t time.Time) error
+	SyscallConn() (syscall.RawConn, error)
+
+	// TLS - the state of the TLS connection the client speaks SOCKS over,
+	// see `Config.TLSConfig`. Nil for plain connections.
+	TLS() *tls.ConnectionState
+}
+
+// clientConn - restricts a net.Conn to the ClientConn methods
+type clientConn struct {
+	conn net.Conn
+}
+
+// newClientConn - wraps the client connection for hooks
+func newClientConn(conn net.Conn) ClientConn {
+	return clientConn{conn: conn}
+}
+
+func (c clientConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c clientConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c clientConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SyscallConn - returns the raw connection of the underlying socket, if the
+// client connection is backed by one
+func (c clientConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := findConn[syscall.Conn](c.conn); ok {
+		return sc.SyscallConn()
+	}
+
+	return nil, errors.New("client connection has no underlying socket")
+}
+
+func (c clientConn) TLS() *tls.ConnectionState {
+	tc, ok := findConn[*tls.Conn](c.conn)
+	if !ok {
+		return nil
+	}
+
+	state := tc.ConnectionState()
+	return &state
+}
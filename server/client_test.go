@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientConnInHooks(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+
+	type seen struct {
+		remote  string
+		version uint16
+		tls     bool
+		raw     error
+	}
+	seenc := make(chan seen, 1)
+
+	srv := startServer(t, Config{
+		TLSConfig: selfSignedConfig(t),
+		Authorize: func(ctx context.Context, client ClientConn, user string, req Socks5_Req) error {
+			s := seen{remote: client.RemoteAddr().String()}
+			if state := client.TLS(); state != nil {
+				s.tls, s.version = true, state.Version
+			}
+			_, s.raw = client.SyscallConn()
+
+			seenc <- s
+			return nil
+		},
+	})
+
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, NO_AUTHENTICATION_REQUIRED_method})
+	readN(t, conn, 2)
+	write(t, conn, ipReq(CONNECT_cmd, echo))
+	readReply(t, conn)
+
+	got := <-seenc
+	if got.remote != conn.LocalAddr().String() {
+		t.Fatalf("RemoteAddr = %s, want the client's %s", got.remote, conn.LocalAddr())
+	}
+
+	if !got.tls || got.version != tls.VersionTLS13 {
+		t.Fatalf("TLS state = %v version %x, want TLS 1.3", got.tls, got.version)
+	}
+
+	// the socket under the TLS connection is reached
+	if got.raw != nil {
+		t.Fatalf("SyscallConn: %v", got.raw)
+	}
+}
+
+func TestClientConnPlainHasNoTLS(t *testing.T) {
+	errc := make(chan error, 1)
+	srv := startServer(t, Config{
+		Authorize: func(ctx context.Context, client ClientConn, user string, req Socks5_Req) error {
+			if client.TLS() != nil {
+				errc <- errors.New("TLS state on a plain connection")
+			}
+			close(errc)
+			return nil
+		},
+	})
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, startEcho(t).(*net.TCPAddr)))
+	readReply(t, conn)
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+)
+
+// connIDKey - the context key of the connection ID
+type connIDKey struct{}
+
+// newConnID - returns a random ID for an accepted connection
+func newConnID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// withConnID - returns a copy of ctx carrying the connection ID
+func withConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// ConnID - returns the ID the client connection was given when accepted, as
+// logged under "conn_id", from the context handed to hooks such as
+// `Config.OnConnect` and `Config.Authorize`. Empty if ctx carries none.
+func ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+// logger - returns the configured logger, adding the connection ID carried by
+// ctx to every line
+func (s *Server) logger(ctx context.Context) *slog.Logger {
+	if id := ConnID(ctx); len(id) > 0 {
+		return s.cfg.logger().With("conn_id", id)
+	}
+
+	return s.cfg.logger()
+}
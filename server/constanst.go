@@ -3,6 +3,9 @@ package server
 // SOCKS5H_VERSION - SOCKS5H Version
 const SOCKS5H_VERSION = 0x05
 
+// SOCKS4_VERSION - SOCKS4 and SOCKS4a Version, see `Config.AllowSOCKS4`
+const SOCKS4_VERSION = 0x04
+
 // RSV - Reserved
 const RSV = 0x00
 
@@ -24,6 +27,18 @@ const (
 	// X'80' to X'FE' RESERVED FOR PRIVATE METHODS
 )
 
+// Username/Password sub-negotiation Constants
+const (
+	// USERNAME_PASSWORD_VERSION - version of the sub-negotiation: X'01'
+	USERNAME_PASSWORD_VERSION = 0x01
+
+	// USERNAME_PASSWORD_SUCCESS_status - X'00' success
+	USERNAME_PASSWORD_SUCCESS_status = 0x00
+
+	// USERNAME_PASSWORD_FAILURE_status - X'01' failure
+	USERNAME_PASSWORD_FAILURE_status = 0x01
+)
+
 // Command Constants
 const (
 	// CONNECT_cmd - CONNECT X'01'
@@ -82,5 +97,10 @@ const (
 
 // Dial-up Constants
 const (
+	TCP    = "tcp"
 	TCP_V4 = "tcp4"
+	TCP_V6 = "tcp6"
+	UDP    = "udp"
+	UDP_V4 = "udp4"
+	UDP_V6 = "udp6"
 )
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Resolver - resolves the domain names of requests. *net.Resolver satisfies
+// it. The ctx of a lookup carries the address families the dial can use, see
+// LookupNetwork, so that a resolver may skip the records of the others.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// lookupNetworkKey - the context key of the lookup network hint
+type lookupNetworkKey struct{}
+
+// LookupNetwork - returns the address families a lookup is for, from the
+// ctx handed to `Resolver.LookupHost`: "ip4" for A records only, "ip6" for
+// AAAA records only or "ip" for both. It follows the outbound network of
+// the request, e.g. "ip4" when `Config.OutboundNetwork` is "tcp4", as
+// addresses of the other family are dropped anyway. Defaults to "ip".
+func LookupNetwork(ctx context.Context) string {
+	if network, ok := ctx.Value(lookupNetworkKey{}).(string); ok {
+		return network
+	}
+
+	return "ip"
+}
+
+// withLookupNetwork - returns a copy of ctx carrying the lookup network hint
+// for dialing on `network`
+func withLookupNetwork(ctx context.Context, network string) context.Context {
+	hint := "ip"
+	switch network {
+	case TCP_V4:
+		hint = "ip4"
+	case TCP_V6:
+		hint = "ip6"
+	}
+
+	return context.WithValue(ctx, lookupNetworkKey{}, hint)
+}
+
+// dialDomain - resolves the domain name of the request and dials its
+// addresses in turn until one connects, trying at most
+// `Config.MaxDialAttempts` of them. Only addresses of the family of the
+// outbound network are dialed. Domains resolving to one of the server's own
+// listen addresses are rejected, as dialing them would loop. IP literal
+// requests are dialed the same way, as a single address. With
+// `Config.OutboundFollowsClient` the addresses of the family of `client`
+// are dialed first. On failure the reply code to send is returned.
+func (s *Server) dialDomain(ctx context.Context, req Socks5_Req, client net.Addr) (net.Conn, byte, error) {
+	network := s.cfg.outboundNetwork(req)
+
+	// IP literals need no resolving
+	addrs := []string{req.AddrStr()}
+
+	if req.AType == DOMAINNAME_addr {
+		var err error
+		if addrs, err = s.lookupHost(withLookupNetwork(ctx, network), req.AddrStr()); err != nil {
+			return nil, HOST_UNREACHABLE_connReply, err
+		}
+	}
+
+	addrs = filterFamily(addrs, network)
+	if len(addrs) == 0 {
+		return nil, HOST_UNREACHABLE_connReply, fmt.Errorf("%s has no %s addresses", req.AddrStr(), network)
+	}
+
+	if network == TCP && s.cfg.OutboundFollowsClient {
+		addrs = preferFamily(addrs, addrIP(client))
+	}
+
+	for _, addr := range addrs {
+		if s.isSelf(net.ParseIP(addr), req.PortNum()) {
+			return nil, CONNECTION_NOT_ALLOWED_BY_RULESET_connReply, fmt.Errorf("%w: %s resolves to %s", ErrLoop, req.AddrStr(), addr)
+		}
+	}
+
+	attempts := len(addrs)
+	if s.cfg.MaxDialAttempts > 0 {
+		attempts = min(attempts, s.cfg.MaxDialAttempts)
+	}
+
+	port := strconv.Itoa(req.PortNum())
+	var dialErrs []error
+
+	for _, addr := range addrs[:attempts] {
+		remote, err := s.cfg.dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return remote, SUCCEEDED_connReply, nil
+		}
+
+		dialErrs = append(dialErrs, err)
+	}
+
+	err := errors.Join(dialErrs...)
+
+	// the destination may still be reachable through the addresses left out
+	if attempts < len(addrs) {
+		return nil, HOST_UNREACHABLE_connReply, err
+	}
+
+	return nil, dialErrorReply(dialErrs[len(dialErrs)-1]), err
+}
+
+// lookupHost - resolves the domain name with the configured Resolver, joining
+// a lookup of it in progress with `Config.CoalesceLookups`
+func (s *Server) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if s.cfg.CoalesceLookups {
+		return s.lookups.lookup(ctx, s.cfg.resolver(), host)
+	}
+
+	return s.cfg.resolver().LookupHost(ctx, host)
+}
+
+// observeDial - records how long resolving and dialing a destination took,
+// warning about dials slower than `Config.SlowDialThreshold`
+func (s *Server) observeDial(ctx context.Context, start time.Time, dest string, err error) {
+	elapsed := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	s.cfg.metrics().Observe(MetricDialDuration, elapsed.Seconds(), map[string]string{"result": result})
+
+	if threshold := s.cfg.SlowDialThreshold; threshold > 0 && elapsed > threshold {
+		s.logger(ctx).Warn("slow dial", "dst", dest, "elapsed", elapsed, "result", result)
+	}
+}
+
+// preferFamily - returns the IP addresses with those of the family of `ip`
+// first, keeping their order otherwise. `addrs` is left as is, as the
+// resolver may share it between lookups.
+func preferFamily(addrs []string, ip net.IP) []string {
+	if ip == nil {
+		return addrs
+	}
+
+	isV4 := ip.To4() != nil
+	addrs = slices.Clone(addrs)
+	slices.SortStableFunc(addrs, func(a, b string) int {
+		aMatch := (net.ParseIP(a).To4() != nil) == isV4
+		bMatch := (net.ParseIP(b).To4() != nil) == isV4
+
+		switch {
+		case aMatch == bMatch:
+			return 0
+		case aMatch:
+			return -1
+		}
+
+		return 1
+	})
+
+	return addrs
+}
+
+// filterFamily - keeps the IP addresses that can be dialed on `network`
+func filterFamily(addrs []string, network string) []string {
+	if network != TCP_V4 && network != TCP_V6 {
+		return addrs
+	}
+
+	var filtered []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+
+		if (ip.To4() != nil) == (network == TCP_V4) {
+			filtered = append(filtered, addr)
+		}
+	}
+
+	return filtered
+}
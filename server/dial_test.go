@@ -0,0 +1,486 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLookupNetworkFollowsOutboundNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		network string
+		lookup  string
+		dialed  string
+	}{
+		{TCP_V4, "ip4", "127.0.0.1:80"},
+		{TCP_V6, "ip6", "[::1]:80"},
+	} {
+		resolver := &staticResolver{addrs: []string{"::1", "127.0.0.1"}}
+
+		var mu sync.Mutex
+		var dialed []string
+
+		srv := startServer(t, Config{
+			OutboundNetwork: tc.network,
+			Resolver:        resolver,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				dialed = append(dialed, network+" "+addr)
+				mu.Unlock()
+
+				return nil, errors.New("unreachable")
+			},
+		})
+
+		conn := negotiate(t, srv)
+		write(t, conn, domainReq(CONNECT_cmd, "dual.example", 80))
+		readReply(t, conn)
+
+		resolver.mu.Lock()
+		networks := resolver.networks
+		resolver.mu.Unlock()
+
+		if !slices.Equal(networks, []string{tc.lookup}) {
+			t.Fatalf("%s: lookup networks = %q, want %s", tc.network, networks, tc.lookup)
+		}
+
+		// only the address of the outbound family is dialed
+		mu.Lock()
+		if want := []string{tc.network + " " + tc.dialed}; !slices.Equal(dialed, want) {
+			t.Fatalf("%s: dialed %q, want %q", tc.network, dialed, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestMaxDialAttempts(t *testing.T) {
+	for _, tc := range []struct {
+		max     int
+		dials   int
+		replied byte
+	}{
+		{max: 0, dials: 4, replied: CONNECTION_REFUSED_connReply},
+		{max: 2, dials: 2, replied: HOST_UNREACHABLE_connReply},
+		{max: 9, dials: 4, replied: CONNECTION_REFUSED_connReply},
+	} {
+		var dials atomic.Int32
+		srv := startServer(t, Config{
+			Resolver:        &staticResolver{addrs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+			MaxDialAttempts: tc.max,
+			Dial: func(context.Context, string, string) (net.Conn, error) {
+				dials.Add(1)
+				return nil, syscall.ECONNREFUSED
+			},
+		})
+
+		conn := negotiate(t, srv)
+		write(t, conn, domainReq(CONNECT_cmd, "example.com", 80))
+
+		if reply := readReply(t, conn); reply.rep != tc.replied {
+			t.Errorf("MaxDialAttempts %d: reply = %s, want %s", tc.max, replyName(reply.rep), replyName(tc.replied))
+		}
+
+		if got := dials.Load(); got != int32(tc.dials) {
+			t.Errorf("MaxDialAttempts %d: dialed %d addresses, want %d", tc.max, got, tc.dials)
+		}
+	}
+}
+
+func TestDialTimeoutFor(t *testing.T) {
+	var mu sync.Mutex
+	budgets := make(map[string]time.Duration)
+
+	srv := startServer(t, Config{
+		DialTimeout: time.Minute,
+		DialTimeoutFor: func(req Socks5_Req) time.Duration {
+			if req.PortNum() == 5432 {
+				return time.Second
+			}
+			return 0
+		},
+		Dial: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return nil, errors.New("dial without a deadline")
+			}
+
+			mu.Lock()
+			budgets[addr] = time.Until(deadline)
+			mu.Unlock()
+			return nil, syscall.ECONNREFUSED
+		},
+	})
+
+	for _, port := range []int{5432, 80} {
+		conn := negotiate(t, srv)
+		write(t, conn, ipReq(CONNECT_cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}))
+
+		if reply := readReply(t, conn); reply.rep != CONNECTION_REFUSED_connReply {
+			t.Fatalf("port %d: reply = %s, want connection refused", port, replyName(reply.rep))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the override applies to its request only, the others keep DialTimeout
+	if got := budgets["127.0.0.1:5432"]; got <= 0 || got > time.Second {
+		t.Errorf("port 5432 dialed with %v left, want at most the 1s override", got)
+	}
+
+	if got := budgets["127.0.0.1:80"]; got <= time.Second || got > time.Minute {
+		t.Errorf("port 80 dialed with %v left, want DialTimeout", got)
+	}
+}
+
+func TestUpstreamHTTPProxy(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nbanner"))
+	}()
+
+	proxy, _ := url.Parse("http://user:pass@" + l.Addr().String())
+	srv := startServer(t, Config{UpstreamHTTPProxy: proxy})
+
+	conn := negotiate(t, srv)
+	write(t, conn, domainReq(CONNECT_cmd, "example.com", 443))
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("reply = %s", replyName(reply.rep))
+	}
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "example.com:443" {
+		t.Fatalf("proxy got %s %s, want CONNECT example.com:443", req.Method, req.Host)
+	}
+
+	if len(req.Header.Get("Proxy-Authorization")) == 0 {
+		t.Fatal("proxy credentials weren't sent")
+	}
+
+	// bytes the proxy sent along with its response reach the client
+	if got := readN(t, conn, 6); string(got) != "banner" {
+		t.Fatalf("read %q, want banner", got)
+	}
+}
+
+// deadlineRecorder - records the deadlines set on the connection
+type deadlineRecorder struct {
+	net.Conn
+
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (d *deadlineRecorder) SetDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.deadlines = append(d.deadlines, t)
+	d.mu.Unlock()
+
+	return d.Conn.SetDeadline(t)
+}
+
+func TestUpstreamHTTPProxyHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}()
+
+	var upstream *deadlineRecorder
+	proxy, _ := url.Parse("http://" + l.Addr().String())
+	srv := startServer(t, Config{
+		UpstreamHTTPProxy: proxy,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			upstream = &deadlineRecorder{Conn: conn}
+			return upstream, nil
+		},
+	})
+
+	start := time.Now()
+	conn := negotiate(t, srv)
+	write(t, conn, domainReq(CONNECT_cmd, "example.com", 443))
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("reply = %s", replyName(reply.rep))
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	// without a dial timeout the exchange is still bounded, then the
+	// deadline is lifted for the tunnel
+	if len(upstream.deadlines) != 2 || !upstream.deadlines[1].IsZero() {
+		t.Fatalf("deadlines = %v, want one lifted after the exchange", upstream.deadlines)
+	}
+
+	if bound := upstream.deadlines[0].Sub(start); bound <= 0 || bound > proxyHandshakeTimeout+time.Second {
+		t.Fatalf("exchange bounded by %v, want %v", bound, proxyHandshakeTimeout)
+	}
+}
+
+func TestDialFailureCooldown(t *testing.T) {
+	var dials atomic.Int32
+	srv := startServer(t, Config{
+		DialFailureCooldown:  time.Minute,
+		DialFailureThreshold: 2,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, syscall.ECONNREFUSED
+		},
+	})
+
+	want := []byte{CONNECTION_REFUSED_connReply, CONNECTION_REFUSED_connReply, HOST_UNREACHABLE_connReply}
+	for i, rep := range want {
+		conn := negotiate(t, srv)
+		write(t, conn, domainReq(CONNECT_cmd, "127.0.0.1", 9))
+
+		if reply := readReply(t, conn); reply.rep != rep {
+			t.Fatalf("request %d: reply = %s, want %s", i, replyName(reply.rep), replyName(rep))
+		}
+	}
+
+	if got := dials.Load(); got != 2 {
+		t.Fatalf("%d dials, want none once cooling down", got)
+	}
+}
+
+func TestPostDial(t *testing.T) {
+	echo := startEcho(t)
+	errHandshake := errors.New("remote handshake failed")
+
+	var mu sync.Mutex
+	var dialed []string
+	srv := startServer(t, Config{
+		PostDial: func(req Socks5_Req, _ string, remote net.Conn) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, remote.RemoteAddr().String())
+			mu.Unlock()
+
+			if req.PortNum() != echo.(*net.TCPAddr).Port {
+				return nil, errHandshake
+			}
+
+			// the echo sends the preamble back first
+			_, err := remote.Write([]byte("hello "))
+			return remote, err
+		},
+	})
+
+	conn := connect(t, srv, echo)
+	write(t, conn, []byte("world"))
+	if got := readN(t, conn, 11); string(got) != "hello world" {
+		t.Fatalf("read %q, want the preamble PostDial wrote to the remote", got)
+	}
+
+	// a PostDial failure fails the request, once the remote was dialed
+	other := startEcho(t)
+	conn = negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, other.(*net.TCPAddr)))
+	if reply := readReply(t, conn); reply.rep != GENERAL_SOCKS_SERVER_FAILURE_connReply {
+		t.Fatalf("reply = %s, want general failure", replyName(reply.rep))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := []string{echo.String(), other.String()}; !slices.Equal(dialed, want) {
+		t.Fatalf("PostDial got remotes %v, want %v", dialed, want)
+	}
+}
+
+func TestPostDialServerName(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+	overridden := startEcho(t).(*net.TCPAddr)
+
+	var mu sync.Mutex
+	var names []string
+	srv := startServer(t, Config{
+		Resolver: &staticResolver{addrs: []string{"127.0.0.1"}},
+		ServerNameFor: func(req Socks5_Req) string {
+			if req.PortNum() == overridden.Port {
+				return "db.internal"
+			}
+			return ""
+		},
+		PostDial: func(_ Socks5_Req, serverName string, remote net.Conn) (net.Conn, error) {
+			mu.Lock()
+			names = append(names, serverName)
+			mu.Unlock()
+			return remote, nil
+		},
+	})
+
+	conn := negotiate(t, srv)
+	write(t, conn, domainReq(CONNECT_cmd, "echo.example.com", echo.Port))
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("reply = %s", replyName(reply.rep))
+	}
+
+	connect(t, srv, echo)
+	connect(t, srv, overridden)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the requested domain, none for an IP literal, then the override
+	if want := []string{"echo.example.com", "", "db.internal"}; !slices.Equal(names, want) {
+		t.Fatalf("server names = %q, want %q", names, want)
+	}
+}
+
+func TestSlowDialThreshold(t *testing.T) {
+	logger, logs := newTestLogger()
+	srv := startServer(t, Config{
+		Logger:            logger,
+		SlowDialThreshold: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasSuffix(addr, ":9") {
+				time.Sleep(100 * time.Millisecond)
+				return nil, syscall.ECONNREFUSED
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	})
+
+	// a fast dial isn't reported
+	echo := startEcho(t)
+	connect(t, srv, echo)
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}))
+	readReply(t, conn)
+
+	waitForLog(t, logs, "slow dial")
+
+	var slow []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "slow dial") {
+			slow = append(slow, line)
+		}
+	}
+
+	if len(slow) != 1 || !strings.Contains(slow[0], "level=WARN") || !strings.Contains(slow[0], "dst=127.0.0.1:9") || !strings.Contains(slow[0], "result=failure") {
+		t.Fatalf("slow dial logs = %q, want one warning for 127.0.0.1:9", slow)
+	}
+}
+
+func TestOutboundFollowsClient(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		listen string
+		addrs  []string
+		first  string
+	}{
+		{name: "IPv4 client", listen: "127.0.0.1:0", addrs: []string{"::1", "127.0.0.1"}, first: "127.0.0.1:80"},
+		{name: "IPv6 client", listen: "[::1]:0", addrs: []string{"127.0.0.1", "::1"}, first: "[::1]:80"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if strings.HasPrefix(tc.listen, "[") {
+				requireIPv6(t)
+			}
+
+			var mu sync.Mutex
+			var dialed []string
+
+			resolver := &staticResolver{addrs: tc.addrs}
+			srv := startServer(t, Config{
+				Addr:                  tc.listen,
+				OutboundFollowsClient: true,
+				Resolver:              resolver,
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					mu.Lock()
+					dialed = append(dialed, addr)
+					mu.Unlock()
+
+					return nil, errors.New("unreachable")
+				},
+			})
+
+			conn := negotiate(t, srv)
+			write(t, conn, domainReq(CONNECT_cmd, "dual.example", 80))
+			readReply(t, conn)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// the address of the client's family is dialed first, then the
+			// other one
+			if len(dialed) != 2 || dialed[0] != tc.first {
+				t.Fatalf("dialed %q, want %s first", dialed, tc.first)
+			}
+
+			// the resolver's answer isn't reordered in place
+			if !slices.Equal(resolver.addrs, tc.addrs) {
+				t.Fatalf("resolver addresses became %q", resolver.addrs)
+			}
+		})
+	}
+}
+
+func TestCoalesceLookups(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+	resolver := &staticResolver{addrs: []string{"127.0.0.1"}, delay: 100 * time.Millisecond}
+	srv := startServer(t, Config{CoalesceLookups: true, Resolver: resolver})
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn := negotiate(t, srv)
+			conn.Write(domainReq(CONNECT_cmd, "popular.example", echo.Port))
+			if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+				t.Errorf("reply = %s", replyName(reply.rep))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := resolver.lookups.Load(); got != 1 {
+		t.Fatalf("%d lookups, want the concurrent ones coalesced into 1", got)
+	}
+}
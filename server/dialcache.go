@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDialCooldown - the destination failed too many dials in a row and isn't
+// dialed until its cooldown is over
+var ErrDialCooldown = errors.New("socks5h: destination is cooling down after failed dials")
+
+// Negative dial cache defaults
+const (
+	// defaultDialFailureThreshold - consecutive failures starting a cooldown
+	defaultDialFailureThreshold = 3
+
+	// dialFailuresSweepSize - the number of tracked destinations past which
+	// stale ones are swept on the next failure
+	dialFailuresSweepSize = 1024
+)
+
+// dialFailures - counts the consecutive dial failures per destination, to
+// short-circuit dialing destinations that keep failing
+type dialFailures struct {
+	mu    sync.Mutex
+	dests map[string]*destFailures
+}
+
+// destFailures - the failed dials of a destination
+type destFailures struct {
+	// count - consecutive failures since `first`
+	count int
+	first time.Time
+
+	// until - the end of the cooldown, if the destination is cooling down
+	until time.Time
+}
+
+// newDialFailures - creates an empty negative dial cache
+func newDialFailures() *dialFailures {
+	return &dialFailures{dests: make(map[string]*destFailures)}
+}
+
+// coolingDown - reports whether the destination is cooling down at `now`
+func (d *dialFailures) coolingDown(dest string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.dests[dest]
+	return ok && now.Before(f.until)
+}
+
+// record - records the outcome of a dial to the destination. `threshold`
+// failures within `window` start a cooldown of `cooldown`, while a success
+// forgets the destination.
+func (d *dialFailures) record(dest string, failed bool, now time.Time, threshold int, window, cooldown time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !failed {
+		delete(d.dests, dest)
+		return
+	}
+
+	f, ok := d.dests[dest]
+	if !ok || now.Sub(f.first) > window {
+		if len(d.dests) >= dialFailuresSweepSize {
+			d.sweep(now, window)
+		}
+
+		f = &destFailures{first: now}
+		d.dests[dest] = f
+	}
+
+	f.count++
+	if f.count >= threshold {
+		f.until = now.Add(cooldown)
+		f.count, f.first = 0, now
+	}
+}
+
+// sweep - forgets the destinations whose window and cooldown are over
+func (d *dialFailures) sweep(now time.Time, window time.Duration) {
+	for dest, f := range d.dests {
+		if now.Sub(f.first) > window && !now.Before(f.until) {
+			delete(d.dests, dest)
+		}
+	}
+}
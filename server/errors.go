@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Handshake errors, to tell apart why a handshake failed
+var (
+	// ErrTLSHandshake - the client failed the TLS handshake of a
+	// SOCKS-over-TLS listener, e.g. offering only versions below
+	// MinTLSVersion
+	ErrTLSHandshake = errors.New("socks5h: TLS handshake failed")
+
+	// ErrBadVersion - the client didn't speak SOCKS5
+	ErrBadVersion = errors.New("socks5h: non socks5h connection received")
+
+	// ErrEarlyDisconnect - the client closed the connection cleanly before
+	// sending its methods, as port scanners do. Such connections are logged
+	// at debug level only.
+	ErrEarlyDisconnect = errors.New("socks5h: client closed before sending methods")
+
+	// ErrShortMethods - the client sent fewer methods than its NMETHODS
+	// announced before closing the connection
+	ErrShortMethods = errors.New("socks5h: fewer methods than announced by nmethods")
+
+	// ErrNoAcceptableMethods - none of the methods offered by the client are
+	// acceptable
+	ErrNoAcceptableMethods = errors.New("socks5h: no acceptable methods offered by client")
+
+	// ErrMethodsTimeout - the client took longer than MethodsTimeout to send
+	// its methods
+	ErrMethodsTimeout = errors.New("socks5h: methods read timed out")
+
+	// ErrAuthTimeout - the auth sub-negotiation took longer than AuthTimeout
+	ErrAuthTimeout = errors.New("socks5h: auth sub-negotiation timed out")
+
+	// ErrBadRequest - the client sent a malformed request
+	ErrBadRequest = errors.New("socks5h: bad request")
+
+	// ErrHandshakeTooLarge - the client sent more than MaxHandshakeBytes
+	// before completing the handshake
+	ErrHandshakeTooLarge = errors.New("socks5h: handshake too large")
+)
+
+// Handshake failure categories, used as the "reason" label of
+// MetricHandshakeFailed
+const (
+	failureTLSHandshake     = "tls_handshake"
+	failureBadVersion       = "bad_version"
+	failureEarlyDisconnect  = "early_disconnect"
+	failureShortMethods     = "short_methods"
+	failureMethodsTimeout   = "methods_timeout"
+	failureNoAcceptable     = "no_acceptable_method"
+	failureAuth             = "auth_failed"
+	failureAuthTimeout      = "auth_timeout"
+	failureAuthBackend      = "auth_backend_error"
+	failureBadRequest       = "bad_request"
+	failureTooLarge         = "handshake_too_large"
+	failureClientDisconnect = "client_disconnect"
+	failureOther            = "other"
+)
+
+// handshakeFailure - returns the category of a handshake error
+func handshakeFailure(err error) string {
+	switch {
+	case errors.Is(err, ErrTLSHandshake):
+		return failureTLSHandshake
+	case errors.Is(err, ErrBadVersion):
+		return failureBadVersion
+	case errors.Is(err, ErrEarlyDisconnect):
+		return failureEarlyDisconnect
+	case errors.Is(err, ErrShortMethods):
+		return failureShortMethods
+	case errors.Is(err, ErrMethodsTimeout):
+		return failureMethodsTimeout
+	case errors.Is(err, ErrNoAcceptableMethods):
+		return failureNoAcceptable
+	case errors.Is(err, ErrAuthTimeout):
+		return failureAuthTimeout
+	case errors.Is(err, ErrAuthFailed):
+		return failureAuth
+	case errors.Is(err, ErrAuthBackend):
+		return failureAuthBackend
+	case errors.Is(err, ErrBadRequest):
+		return failureBadRequest
+	case errors.Is(err, ErrHandshakeTooLarge):
+		return failureTooLarge
+	case isDisconnect(err):
+		return failureClientDisconnect
+	}
+
+	return failureOther
+}
+
+// isDisconnect - reports whether the error means the peer went away
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// listenError - explains a failure to bind `addr`, pointing at the fix when
+// the port is privileged
+func listenError(addr string, err error) error {
+	if errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("socks5h: no permission to listen on %s, ports below 1024 "+
+			"need root or the CAP_NET_BIND_SERVICE capability (e.g. setcap "+
+			"cap_net_bind_service=+ep on the binary), or pick a port of 1024 or above: %w", addr, err)
+	}
+
+	return fmt.Errorf("socks5h: listen on %s: %w", addr, err)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestHandshakeFailureCategories(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{ErrTLSHandshake, failureTLSHandshake},
+		{ErrBadVersion, failureBadVersion},
+		{fmt.Errorf("%w: %w", ErrEarlyDisconnect, io.EOF), failureEarlyDisconnect},
+		{fmt.Errorf("%w: %w", ErrShortMethods, io.ErrUnexpectedEOF), failureShortMethods},
+		{ErrMethodsTimeout, failureMethodsTimeout},
+		{ErrNoAcceptableMethods, failureNoAcceptable},
+		{ErrAuthFailed, failureAuth},
+		{ErrAuthTimeout, failureAuthTimeout},
+		{ErrAuthBackend, failureAuthBackend},
+		{ErrBadRequest, failureBadRequest},
+		{ErrHandshakeTooLarge, failureTooLarge},
+		{io.EOF, failureClientDisconnect},
+		{io.ErrUnexpectedEOF, failureClientDisconnect},
+		{net.ErrClosed, failureClientDisconnect},
+		{syscall.ECONNRESET, failureClientDisconnect},
+		{syscall.EPIPE, failureClientDisconnect},
+		{errors.New("boom"), failureOther},
+	} {
+		// the category survives the wrapping of the handshake steps
+		wrapped := fmt.Errorf("reading request: %w", tc.err)
+
+		if got := handshakeFailure(wrapped); got != tc.want {
+			t.Errorf("handshakeFailure(%v) = %s, want %s", wrapped, got, tc.want)
+		}
+	}
+}
+
+func TestHandshakeFailureMetric(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{Metrics: metrics})
+
+	// a client speaking another protocol, then one leaving mid-request
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{0x16, 0x03, 0x01})
+	conn.Read(make([]byte, 1))
+
+	conn = negotiate(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, CONNECT_cmd})
+	conn.Close()
+
+	for _, reason := range []string{failureBadVersion, failureClientDisconnect} {
+		waitFor(t, reason, func() bool {
+			return metrics.count(MetricHandshakeFailed, "reason", reason) == 1
+		})
+	}
+}
+
+// serveOne - serves one connection on which the client sends `b` and
+// returns the error the server reports for it
+func serveOne(t *testing.T, cfg Config, b []byte) (error, net.Addr) {
+	t.Helper()
+
+	cfg.Addr = "127.0.0.1:0"
+	srv, err := Listen(cfg)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	client, server := tcpPair(t)
+	write(t, client, b)
+	client.CloseWrite()
+	go io.Copy(io.Discard, client)
+
+	return srv.handle_socks5_connection(server, context.Background()), client.LocalAddr()
+}
+
+func TestServeErrorsKeepTheirCause(t *testing.T) {
+	methods := []byte{SOCKS5H_VERSION, 1, NO_AUTHENTICATION_REQUIRED_method}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	cfg := Config{
+		Dial: func(context.Context, string, string) (net.Conn, error) { return nil, refused },
+	}
+
+	err, client := serveOne(t, cfg, append(methods, ipReq(CONNECT_cmd, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80})...))
+
+	var opErr *net.OpError
+	if !errors.Is(err, syscall.ECONNREFUSED) || !errors.As(err, &opErr) || opErr != refused {
+		t.Errorf("dial failure = %v, want it to wrap the dial error", err)
+	}
+
+	if !strings.Contains(err.Error(), client.String()) {
+		t.Errorf("dial failure %q lacks the client address %s", err, client)
+	}
+
+	err, client = serveOne(t, cfg, append(methods, SOCKS5H_VERSION, CONNECT_cmd))
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) || handshakeFailure(err) != failureClientDisconnect {
+		t.Errorf("truncated request = %v, want it to wrap io.ErrUnexpectedEOF", err)
+	}
+
+	if !strings.Contains(err.Error(), client.String()) {
+		t.Errorf("truncated request %q lacks the client address %s", err, client)
+	}
+
+	if err, _ = serveOne(t, cfg, []byte{SOCKS5H_VERSION, 2, NO_AUTHENTICATION_REQUIRED_method}); !errors.Is(err, ErrShortMethods) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short methods = %v, want ErrShortMethods wrapping io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestListenErrorExplainsPrivilegedPorts(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+
+	err := listenError(":80", denied)
+	if !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("listenError = %v, want it to wrap EACCES", err)
+	}
+
+	for _, hint := range []string{":80", "CAP_NET_BIND_SERVICE", "port of 1024 or above"} {
+		if !strings.Contains(err.Error(), hint) {
+			t.Errorf("listenError = %q, lacks %q", err, hint)
+		}
+	}
+
+	// other failures are only wrapped
+	inUse := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+
+	err = listenError(":1080", inUse)
+	if !errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), "CAP_NET_BIND_SERVICE") {
+		t.Errorf("listenError = %v, want the bare EADDRINUSE", err)
+	}
+}
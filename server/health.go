@@ -0,0 +1,35 @@
+package server
+
+import "errors"
+
+// Ready - reports whether the server is accepting connections, that is once
+// the listener is bound and until Shutdown is called
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+// AddLivenessCheck - registers a check run by Live, e.g. to verify that the
+// upstream network or a credential store is reachable
+func (s *Server) AddLivenessCheck(check func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.livenessChecks = append(s.livenessChecks, check)
+}
+
+// Live - runs the registered liveness checks and returns their errors, or
+// nil if the server is healthy
+func (s *Server) Live() error {
+	s.mu.Lock()
+	checks := append([]func() error(nil), s.livenessChecks...)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, check := range checks {
+		if err := check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestReadyAcrossServeAndShutdown(t *testing.T) {
+	srv, err := Listen(Config{Addr: "127.0.0.1:0", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	if srv.Ready() {
+		t.Fatal("ready before Serve")
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+
+	waitFor(t, "ready", srv.Ready)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if srv.Ready() {
+		t.Fatal("ready after Shutdown")
+	}
+
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestLiveRunsChecks(t *testing.T) {
+	srv := startServer(t, Config{})
+
+	if err := srv.Live(); err != nil {
+		t.Fatalf("live with no checks = %v", err)
+	}
+
+	errDown := errors.New("upstream down")
+	healthy := true
+	srv.AddLivenessCheck(func() error { return nil })
+	srv.AddLivenessCheck(func() error {
+		if healthy {
+			return nil
+		}
+		return errDown
+	})
+
+	if err := srv.Live(); err != nil {
+		t.Fatalf("live with passing checks = %v", err)
+	}
+
+	healthy = false
+	if err := srv.Live(); !errors.Is(err, errDown) {
+		t.Fatalf("live with a failing check = %v, want %v", err, errDown)
+	}
+
+	healthy = true
+	if err := srv.Live(); err != nil {
+		t.Fatalf("live once the check recovers = %v", err)
+	}
+}
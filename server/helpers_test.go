@@ -0,0 +1,396 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTimeout - bounds every read and write of the tests, so that a broken
+// server fails them instead of hanging
+const testTimeout = 5 * time.Second
+
+// startServer - listens on a free loopback port with `cfg` and serves until
+// the test ends. Logs are discarded unless `cfg.Logger` is set.
+func startServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	if len(cfg.Addr) == 0 && len(cfg.ListenAddrs) == 0 {
+		cfg.Addr = "127.0.0.1:0"
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	srv, err := Listen(cfg)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		srv.Serve()
+	}()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		srv.Shutdown(ctx)
+		<-served
+	})
+
+	return srv
+}
+
+// dialServer - connects to the server, closing the connection once the test
+// ends
+func dialServer(t testing.TB, srv *Server) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing server: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// negotiate - connects to the server and negotiates the no-auth method
+func negotiate(t testing.TB, srv *Server) net.Conn {
+	t.Helper()
+
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, NO_AUTHENTICATION_REQUIRED_method})
+
+	if got := readN(t, conn, 2); !bytes.Equal(got, []byte{SOCKS5H_VERSION, NO_AUTHENTICATION_REQUIRED_method}) {
+		t.Fatalf("method selection = %v, want no-auth", got)
+	}
+
+	return conn
+}
+
+// domainReq - encodes a request for `host`:`port` with the domain name ATYP
+func domainReq(cmd byte, host string, port int) []byte {
+	req := []byte{SOCKS5H_VERSION, cmd, RSV, DOMAINNAME_addr, byte(len(host))}
+	req = append(req, host...)
+	return binary.BigEndian.AppendUint16(req, uint16(port))
+}
+
+// ipReq - encodes a request for `addr` with the IPv4 or IPv6 ATYP
+func ipReq(cmd byte, addr *net.TCPAddr) []byte {
+	req := []byte{SOCKS5H_VERSION, cmd, RSV}
+	if v4 := addr.IP.To4(); v4 != nil {
+		req = append(append(req, IP_V4_addr), v4...)
+	} else {
+		req = append(append(req, IP_V6_addr), addr.IP.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+}
+
+// testReply - a reply read by readReply
+type testReply struct {
+	rep  byte
+	addr string
+	port int
+}
+
+// readReply - reads a reply to a request
+func readReply(t testing.TB, conn net.Conn) testReply {
+	t.Helper()
+
+	header := readN(t, conn, 4)
+	if header[0] != SOCKS5H_VERSION {
+		t.Fatalf("reply version = %d, want %d", header[0], SOCKS5H_VERSION)
+	}
+
+	var addr string
+	switch header[3] {
+	case IP_V4_addr:
+		addr = net.IP(readN(t, conn, net.IPv4len)).String()
+	case IP_V6_addr:
+		addr = net.IP(readN(t, conn, net.IPv6len)).String()
+	case DOMAINNAME_addr:
+		addr = string(readN(t, conn, int(readN(t, conn, 1)[0])))
+	default:
+		t.Fatalf("reply atyp = %d", header[3])
+	}
+
+	port := int(binary.BigEndian.Uint16(readN(t, conn, 2)))
+	return testReply{rep: header[1], addr: addr, port: port}
+}
+
+// connect - negotiates and CONNECTs to `addr`, failing the test unless the
+// CONNECT succeeds
+func connect(t testing.TB, srv *Server, addr net.Addr) net.Conn {
+	t.Helper()
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, addr.(*net.TCPAddr)))
+
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("CONNECT reply = %s, want succeeded", replyName(reply.rep))
+	}
+
+	return conn
+}
+
+// write - writes `b` to the connection
+func write(t testing.TB, conn net.Conn, b []byte) {
+	t.Helper()
+
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+}
+
+// readN - reads exactly `n` bytes from the connection
+func readN(t testing.TB, conn net.Conn, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("reading %d bytes: %v", n, err)
+	}
+
+	return b
+}
+
+// startEcho - starts a TCP server echoing back what it reads, until the test
+// ends
+func startEcho(t testing.TB) net.Addr {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr()
+}
+
+// syncBuffer - a bytes.Buffer safe for the concurrent writes of a logger
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// newTestLogger - returns a logger writing every level to the returned buffer
+func newTestLogger() (*slog.Logger, *syncBuffer) {
+	buf := &syncBuffer{}
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})), buf
+}
+
+// waitFor - polls `cond` until it holds, failing the test after testTimeout
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForLog - waits until the log buffer holds `msg`
+func waitForLog(t testing.TB, buf *syncBuffer, msg string) {
+	t.Helper()
+
+	waitFor(t, "log "+msg, func() bool { return strings.Contains(buf.String(), msg) })
+}
+
+// testMetrics - records the counters of the server, summed per name and
+// labels, and its observations
+type testMetrics struct {
+	mu           sync.Mutex
+	counts       map[string]int64
+	observations map[string][]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{counts: make(map[string]int64), observations: make(map[string][]float64)}
+}
+
+func (m *testMetrics) Count(name string, delta int64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[metricKey(name, labels)] += delta
+}
+
+func (m *testMetrics) Observe(name string, value float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricKey(name, labels)
+	m.observations[key] = append(m.observations[key], value)
+}
+
+// observed - returns the observations of `name` over the series with the
+// label `key`=`value`
+func (m *testMetrics) observed(name, key, value string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var values []float64
+	for k, v := range m.observations {
+		if strings.HasPrefix(k, name+"{") && hasLabel(k, key, value) {
+			values = append(values, v...)
+		}
+	}
+
+	return values
+}
+
+// count - returns the counter `name` summed over the series with the label
+// `key`=`value`, or over all of them when `key` is empty
+func (m *testMetrics) count(name, key, value string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for k, v := range m.counts {
+		labeled := strings.HasPrefix(k, name+"{")
+		if (k == name || labeled) && (len(key) == 0 || labeled && hasLabel(k, key, value)) {
+			total += v
+		}
+	}
+
+	return total
+}
+
+// metricKey - renders a counter name and its labels as one key
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(name + "{")
+	for k, v := range labels {
+		b.WriteString(k + "=" + v + ",")
+	}
+
+	return b.String() + "}"
+}
+
+// hasLabel - reports whether the key rendered by metricKey has the label
+// `key`=`value`
+func hasLabel(metric, key, value string) bool {
+	label := key + "=" + value + ","
+	return strings.Contains(metric, "{"+label) || strings.Contains(metric, ","+label)
+}
+
+// staticResolver - resolves every host to the same addresses, recording the
+// lookup network of each lookup
+type staticResolver struct {
+	addrs []string
+	delay time.Duration
+
+	lookups  atomic.Int32
+	mu       sync.Mutex
+	networks []string
+}
+
+func (r *staticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups.Add(1)
+
+	r.mu.Lock()
+	r.networks = append(r.networks, LookupNetwork(ctx))
+	r.mu.Unlock()
+
+	time.Sleep(r.delay)
+	return r.addrs, nil
+}
+
+// requireIPv6 - skips the test if IPv6 loopback is unavailable
+func requireIPv6(t testing.TB) {
+	t.Helper()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	l.Close()
+}
+
+// startGreeter - starts a TCP server that, `delay` after accepting each
+// connection, sends `greeting` or closes the connection if it's empty
+func startGreeter(t testing.TB, delay time.Duration, greeting string) *net.TCPAddr {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				time.Sleep(delay)
+				if len(greeting) == 0 {
+					conn.Close()
+					return
+				}
+
+				conn.Write([]byte(greeting))
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// httpMethods - the request lines an HTTP probe may start with
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "), []byte("PATCH "),
+}
+
+// httpBanner - the body of the response to HTTP probes
+const httpBanner = "This is a SOCKS5 proxy, not an HTTP server or proxy.\n" +
+	"Configure it in your client as a SOCKS proxy (socks5h://).\n"
+
+// looksLikeHTTP - reports whether the first byte read from the client,
+// followed by the bytes already buffered, start an HTTP request line
+func looksLikeHTTP(first byte, rest []byte) bool {
+	for _, method := range httpMethods {
+		if method[0] == first && bytes.HasPrefix(rest, method[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeHTTPBanner - answers an HTTP probe with a 400 explaining that this is
+// a SOCKS proxy
+func writeHTTPBanner(conn net.Conn) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"%s", len(httpBanner), httpBanner)
+
+	return err
+}
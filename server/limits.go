@@ -0,0 +1,30 @@
+package server
+
+import "sync/atomic"
+
+// slots - a counting semaphore capping the number of concurrently held
+// resources. A max of zero or less means unlimited.
+type slots struct {
+	max  int64
+	used atomic.Int64
+}
+
+// newSlots - creates a semaphore with `max` slots
+func newSlots(max int) *slots {
+	return &slots{max: int64(max)}
+}
+
+// acquire - takes a slot, returns false if all of them are in use
+func (l *slots) acquire() bool {
+	if l.used.Add(1) > l.max && l.max > 0 {
+		l.used.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+// release - gives back a slot taken by acquire
+func (l *slots) release() {
+	l.used.Add(-1)
+}
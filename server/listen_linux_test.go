@@ -0,0 +1,29 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestReusePortSharesPort(t *testing.T) {
+	first := startServer(t, Config{ReusePort: true})
+	addr := first.Addr().String()
+
+	second := startServer(t, Config{Addr: addr, ReusePort: true})
+	if got := second.Addr().String(); got != addr {
+		t.Fatalf("second server listens on %s, want %s", got, addr)
+	}
+
+	// the kernel spreads the connections over both listeners
+	for range 4 {
+		connect(t, first, startEcho(t))
+	}
+
+	// without the option the port is taken
+	if _, err := Listen(Config{Addr: addr}); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("listening without ReusePort: %v, want EADDRINUSE", err)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// lookupGroup - coalesces concurrent lookups of the same host into one, see
+// `Config.CoalesceLookups`
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+// lookupCall - a lookup in progress, shared by every request for its host
+type lookupCall struct {
+	done  chan struct{}
+	addrs []string
+	err   error
+}
+
+// newLookupGroup - creates an empty lookupGroup
+func newLookupGroup() *lookupGroup {
+	return &lookupGroup{calls: make(map[string]*lookupCall)}
+}
+
+// lookup - resolves `host` with `resolver`, joining the lookup already in
+// progress for it, and the same LookupNetwork, if any. The lookup runs on
+// its own, so that the request which started it giving up doesn't fail the
+// others; each caller only waits for it as long as its own ctx allows.
+func (g *lookupGroup) lookup(ctx context.Context, resolver Resolver, host string) ([]string, error) {
+	key := LookupNetwork(ctx) + "/" + host
+
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		call = &lookupCall{done: make(chan struct{})}
+		g.calls[key] = call
+
+		go func() {
+			call.addrs, call.err = resolver.LookupHost(context.WithoutCancel(ctx), host)
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		// every caller gets its own copy, as the addresses get reordered
+		return slices.Clone(call.addrs), call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
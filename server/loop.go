@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrLoop - the destination of a request is one of the server's own listen
+// addresses, which would make the server proxy to itself
+var ErrLoop = errors.New("socks5h: destination is the server itself")
+
+// isSelf - reports whether `ip`:`port` is one of the server's listen
+// addresses. A listener bound to the unspecified address (":1080") is
+// reached through every local IP, loopback included.
+func (s *Server) isSelf(ip net.IP, port int) bool {
+	for _, addr := range s.Addrs() {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || tcpAddr.Port != port {
+			continue
+		}
+
+		if tcpAddr.IP.Equal(ip) {
+			return true
+		}
+
+		if tcpAddr.IP.IsUnspecified() && isLocalIP(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLocalIP - reports whether the IP belongs to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
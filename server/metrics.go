@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Metrics - receives the metrics emitted by the server. Implementations must
+// be safe for concurrent use.
+type Metrics interface {
+	// Count - adds `delta` to the counter `name` with the given labels
+	Count(name string, delta int64, labels map[string]string)
+
+	// Observe - records `value` in the histogram `name` with the given labels
+	Observe(name string, value float64, labels map[string]string)
+}
+
+// Metric names. The tunnel metrics are also labeled by the session metadata
+// returned by the authenticator, if any.
+const (
+	// MetricMethodSelected - counts the METHOD selected for each handshake,
+	// labeled by "method"
+	MetricMethodSelected = "socks5h_method_selected_total"
+
+	// MetricHandshakeFailed - counts failed handshakes, labeled by "reason":
+	// tls_handshake, bad_version, early_disconnect, short_methods,
+	// methods_timeout, no_acceptable_method, auth_failed, auth_timeout,
+	// auth_backend_error, bad_request, handshake_too_large,
+	// client_disconnect or other
+	MetricHandshakeFailed = "socks5h_handshake_failures_total"
+
+	// MetricRateLimited - counts the connections closed right after accept
+	// as their client IP went over HandshakeRate
+	MetricRateLimited = "socks5h_rate_limited_total"
+
+	// MetricBytesSent - counts the bytes relayed from clients to remotes,
+	// labeled by "tenant" and by "egress", the local IP CONNECT dialed the
+	// destination from (empty for BIND)
+	MetricBytesSent = "socks5h_bytes_sent_total"
+
+	// MetricBytesReceived - counts the bytes relayed from remotes to clients,
+	// labeled by "tenant" and "egress"
+	MetricBytesReceived = "socks5h_bytes_received_total"
+
+	// MetricTunnelEnded - counts finished tunnels, labeled by "tenant",
+	// "egress" and by "reason": client_eof, remote_eof, remote_reset,
+	// idle_timeout, closed or error
+	MetricTunnelEnded = "socks5h_tunnels_ended_total"
+
+	// MetricTunnelDuration - observes how long tunnels lasted in seconds,
+	// from the start of the relay to its close, labeled by "tenant" and
+	// "egress"
+	MetricTunnelDuration = "socks5h_tunnel_duration_seconds"
+
+	// MetricUDPDropped - counts the datagrams the UDP relay dropped, labeled
+	// by "reason": too_large, queue_full, malformed, denied (by the checks a
+	// CONNECT destination gets) or unresolved
+	MetricUDPDropped = "socks5h_udp_dropped_total"
+
+	// MetricDialDuration - observes how long CONNECT took to resolve and dial
+	// its destination in seconds, labeled by "result": success or failure
+	MetricDialDuration = "socks5h_dial_duration_seconds"
+
+	// MetricRequestDenied - counts the requests denied for their
+	// destination, labeled by "reason": authorize, rules, policy or loop
+	MetricRequestDenied = "socks5h_requests_denied_total"
+
+	// MetricTrackedConnsOverflow - counts the connections accepted while
+	// MaxTrackedConns were tracked, labeled by "action": evicted, a done
+	// connection being closed to make room, or dropped
+	MetricTrackedConnsOverflow = "socks5h_tracked_conns_overflow_total"
+)
+
+// nopMetrics - discards all metrics
+type nopMetrics struct{}
+
+func (nopMetrics) Count(name string, delta int64, labels map[string]string) {}
+
+func (nopMetrics) Observe(name string, value float64, labels map[string]string) {}
+
+// methodName - returns the symbolic name of an authentication METHOD
+func methodName(method byte) string {
+	switch method {
+	case NO_AUTHENTICATION_REQUIRED_method:
+		return "no-auth"
+	case GSSAPI_method:
+		return "gssapi"
+	case USERNAME_PASSWORD_method:
+		return "username-password"
+	case NO_ACCEPTABLE_METHODS_method:
+		return "none"
+	}
+
+	return fmt.Sprintf("0x%02x", method)
+}
+
+// methodNames - returns the symbolic names of the METHODs as a list, e.g.
+// "[no-auth username-password]"
+func methodNames(methods []byte) string {
+	names := make([]string, len(methods))
+	for i, method := range methods {
+		names[i] = methodName(method)
+	}
+
+	return "[" + strings.Join(names, " ") + "]"
+}
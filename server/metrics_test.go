@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMethodSelectedMetric(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		Metrics: metrics,
+		Authenticators: []Authenticator{
+			NoAuthAuthenticator{},
+			UserPassAuthenticator{Validate: func(user, pass string) bool { return true }},
+		},
+	})
+
+	negotiate(t, srv)
+	login(t, srv, "alice", "secret")
+
+	conn := dialServer(t, srv)
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, GSSAPI_method})
+	readN(t, conn, 2)
+
+	for _, method := range []string{"no-auth", "username-password", "none"} {
+		waitFor(t, method+" selected", func() bool {
+			return metrics.count(MetricMethodSelected, "method", method) == 1
+		})
+	}
+}
+
+func TestDialDurationMetric(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		Metrics: metrics,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			time.Sleep(20 * time.Millisecond)
+			if strings.HasSuffix(addr, ":9") {
+				return nil, syscall.ECONNREFUSED
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	})
+
+	connect(t, srv, startEcho(t))
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}))
+	readReply(t, conn)
+
+	for _, result := range []string{"success", "failure"} {
+		var observed []float64
+		waitFor(t, result+" dial observed", func() bool {
+			observed = metrics.observed(MetricDialDuration, "result", result)
+			return len(observed) > 0
+		})
+
+		if len(observed) != 1 || observed[0] < 0.02 || observed[0] > 5 {
+			t.Errorf("%s{result=%s} = %v, want one ~20ms dial", MetricDialDuration, result, observed)
+		}
+	}
+}
+
+func TestTunnelDurationMetric(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		Metrics:   metrics,
+		TenantFor: func(*Session) string { return "acme" },
+	})
+
+	conn := connect(t, srv, startEcho(t))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	var observed []float64
+	waitFor(t, "tunnel duration", func() bool {
+		observed = metrics.observed(MetricTunnelDuration, "tenant", "acme")
+		return len(observed) > 0
+	})
+
+	if len(observed) != 1 || observed[0] < 0.05 || observed[0] > 5 {
+		t.Fatalf("%s{tenant=acme} = %v, want one ~50ms tunnel", MetricTunnelDuration, observed)
+	}
+
+	if got := metrics.observed(MetricTunnelDuration, "egress", "127.0.0.1"); len(got) != 1 {
+		t.Fatalf("%s{egress=127.0.0.1} = %v, want the tunnel", MetricTunnelDuration, got)
+	}
+}
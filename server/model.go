@@ -4,6 +4,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 )
 
 type Socks5_Req struct {
@@ -22,21 +25,90 @@ func (s Socks5_Req) AddrStr() string {
 		return s.addr
 	}
 
-	s.addr = string(s.DstAddr)
+	switch s.AType {
+	case IP_V4_addr, IP_V6_addr:
+		s.addr = net.IP(s.DstAddr).String()
+	default:
+		s.addr = string(s.DstAddr)
+	}
+
 	return s.addr
 }
 
+// Hostname - returns the requested domain name, or empty for IP literal
+// requests
+func (s Socks5_Req) Hostname() string {
+	if s.AType != DOMAINNAME_addr {
+		return ""
+	}
+
+	return strings.TrimSuffix(s.AddrStr(), ".")
+}
+
+// PortNum - returns DST.PORT, or 0 if it isn't 2 bytes long as in a zero or
+// partially filled request
 func (s Socks5_Req) PortNum() int {
 	if s.port > 0 {
 		return s.port
 	}
 
+	if len(s.DstPort) != 2 {
+		return 0
+	}
+
 	s.port = int(binary.BigEndian.Uint16(s.DstPort))
 	return s.port
 }
 
+// FullAddr - returns the destination as "host:port", bracketing IPv6
+// addresses ("[::1]:80") so that the result can be dialed
 func (s Socks5_Req) FullAddr() string {
-	return fmt.Sprintf("%s:%d", s.AddrStr(), s.PortNum())
+	return net.JoinHostPort(s.AddrStr(), strconv.Itoa(s.PortNum()))
+}
+
+// String - renders the request as its command and destination, e.g.
+// "CONNECT example.com:443". A request missing its DST.ADDR or DST.PORT, as
+// a zero or partially filled one, is rendered with a placeholder in place
+// of the destination.
+func (s Socks5_Req) String() string {
+	if len(s.DstAddr) == 0 || len(s.DstPort) != 2 {
+		return fmt.Sprintf("%s <no destination>", cmdName(s.Cmd))
+	}
+
+	return fmt.Sprintf("%s %s", cmdName(s.Cmd), s.FullAddr())
+}
+
+// Encode - returns the request as sent on the wire: VER, CMD, RSV, ATYP,
+// DST.ADDR and DST.PORT, the inverse of ParseRequest. A domain name
+// DST.ADDR is length-prefixed.
+func (s Socks5_Req) Encode() ([]byte, error) {
+	if len(s.DstPort) != 2 {
+		return nil, fmt.Errorf("destination port must be 2 bytes long, got %d", len(s.DstPort))
+	}
+
+	req := []byte{SOCKS5H_VERSION, s.Cmd, RSV, s.AType}
+
+	switch s.AType {
+	case IP_V4_addr:
+		if len(s.DstAddr) != net.IPv4len {
+			return nil, fmt.Errorf("destination IPv4 address must be 4 bytes long, got %d", len(s.DstAddr))
+		}
+	case IP_V6_addr:
+		if len(s.DstAddr) != net.IPv6len {
+			return nil, fmt.Errorf("destination IPv6 address must be 16 bytes long, got %d", len(s.DstAddr))
+		}
+	case DOMAINNAME_addr:
+		if len(s.DstAddr) == 0 || len(s.DstAddr) > 255 {
+			return nil, fmt.Errorf("destination domain name must be 1 to 255 bytes long, got %d", len(s.DstAddr))
+		}
+
+		req = append(req, byte(len(s.DstAddr)))
+	default:
+		return nil, fmt.Errorf("unknown destination address type 0x%02x", s.AType)
+	}
+
+	req = append(req, s.DstAddr...)
+	return append(req, s.DstPort...), nil
 }
 
 type Socks5_Res struct {
@@ -47,6 +119,58 @@ type Socks5_Res struct {
 
 	addr []byte
 	port []byte
+
+	// sent - set when the reply to the request already went out, or failed
+	// to, so that none is sent in its place, see `sentRes`
+	sent bool
+}
+
+// newRes - creates a succeeded reply with no bound address to report,
+// BND.ADDR and BND.PORT being zeroed
+func newRes() Socks5_Res {
+	return Socks5_Res{
+		Reply:    SUCCEEDED_connReply,
+		AType:    IP_V4_addr,
+		BindAddr: net.IPv4zero.String(),
+	}
+}
+
+// newFailureRes - creates a reply carrying only a failure code. BND.ADDR and
+// BND.PORT are zeroed as there is no bound address to report.
+func newFailureRes(reply byte) Socks5_Res {
+	res := newRes()
+	res.Reply = reply
+	return res
+}
+
+// sentRes - marks the failure of a request whose reply was already
+// attempted, e.g. the first reply of BIND, so that no other one follows
+func sentRes() Socks5_Res {
+	return Socks5_Res{sent: true}
+}
+
+// newBindRes - creates a succeeded reply reporting `addr` in BND.ADDR and
+// BND.PORT. Addresses other than TCP ones are reported as zeroed.
+// IPv4-mapped IPv6 addresses (::ffff:a.b.c.d), as found on dual-stack
+// sockets, are reported as plain IPv4 ones.
+func newBindRes(addr net.Addr) Socks5_Res {
+	res := newRes()
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return res
+	}
+
+	if v4 := tcpAddr.IP.To4(); v4 != nil {
+		res.AType = IP_V4_addr
+		res.BindAddr = v4.String()
+	} else if v6 := tcpAddr.IP.To16(); v6 != nil {
+		res.AType = IP_V6_addr
+		res.BindAddr = v6.String()
+	}
+
+	res.BindPort = tcpAddr.Port
+	return res
 }
 
 func (s Socks5_Res) AddrBytes() []byte {
@@ -74,3 +198,97 @@ func (s Socks5_Res) PortBytes() []byte {
 	binary.BigEndian.PutUint16(s.port, uint16(s.BindPort))
 	return s.port
 }
+
+// Encode - returns the reply as sent on the wire: VER, REP, RSV, ATYP,
+// BND.ADDR and BND.PORT. BND.ADDR is encoded per ATYP: 4 bytes for IPv4, 16
+// for IPv6 and a length-prefixed name for a domain name.
+func (s Socks5_Res) Encode() ([]byte, error) {
+	if s.BindPort < 0 || s.BindPort > 0xffff {
+		return nil, fmt.Errorf("bind port %d out of range", s.BindPort)
+	}
+
+	// sized for the IP replies the server sends, so that they're built in a
+	// single allocation
+	reply := make([]byte, 0, maxIPReplySize)
+	reply = append(reply, SOCKS5H_VERSION, s.Reply, RSV, s.AType)
+
+	switch s.AType {
+	case IP_V4_addr:
+		ip, err := netip.ParseAddr(s.BindAddr)
+		if ip = ip.Unmap(); err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("bind address %q isn't an IPv4 address", s.BindAddr)
+		}
+
+		v4 := ip.As4()
+		reply = append(reply, v4[:]...)
+	case IP_V6_addr:
+		ip, err := netip.ParseAddr(s.BindAddr)
+		if err != nil {
+			return nil, fmt.Errorf("bind address %q isn't an IPv6 address", s.BindAddr)
+		}
+
+		v6 := ip.As16()
+		reply = append(reply, v6[:]...)
+	case DOMAINNAME_addr:
+		if len(s.BindAddr) == 0 || len(s.BindAddr) > 255 {
+			return nil, fmt.Errorf("bind domain name %q must be 1 to 255 bytes long", s.BindAddr)
+		}
+
+		reply = append(reply, byte(len(s.BindAddr)))
+		reply = append(reply, s.BindAddr...)
+	default:
+		return nil, fmt.Errorf("unknown bind address type 0x%02x", s.AType)
+	}
+
+	return binary.BigEndian.AppendUint16(reply, uint16(s.BindPort)), nil
+}
+
+// maxIPReplySize - the size of the largest reply with an IP BND.ADDR: VER,
+// REP, RSV, ATYP, an IPv6 BND.ADDR and BND.PORT
+const maxIPReplySize = 4 + net.IPv6len + 2
+
+// String - renders the reply as its code and bound address, e.g.
+// "succeeded 10.0.0.1:1080"
+func (s Socks5_Res) String() string {
+	return fmt.Sprintf("%s %s", replyName(s.Reply), net.JoinHostPort(s.BindAddr, strconv.Itoa(s.BindPort)))
+}
+
+// cmdName - returns the name of a request CMD
+func cmdName(cmd byte) string {
+	switch cmd {
+	case CONNECT_cmd:
+		return "CONNECT"
+	case BIND_cmd:
+		return "BIND"
+	case UDP_ASSOCIATE_cmd:
+		return "UDP ASSOCIATE"
+	}
+
+	return fmt.Sprintf("cmd 0x%02x", cmd)
+}
+
+// replyName - returns the name of a REP code
+func replyName(reply byte) string {
+	switch reply {
+	case SUCCEEDED_connReply:
+		return "succeeded"
+	case GENERAL_SOCKS_SERVER_FAILURE_connReply:
+		return "general SOCKS server failure"
+	case CONNECTION_NOT_ALLOWED_BY_RULESET_connReply:
+		return "connection not allowed by ruleset"
+	case NETWORK_UNREACHABLE_connReply:
+		return "network unreachable"
+	case HOST_UNREACHABLE_connReply:
+		return "host unreachable"
+	case CONNECTION_REFUSED_connReply:
+		return "connection refused"
+	case TTL_EXPIRED_connReply:
+		return "TTL expired"
+	case COMMAND_NOT_SUPPORTED_connReply:
+		return "command not supported"
+	case ADDRESS_TYPE_NOT_SUPPORTED_connReply:
+		return "address type not supported"
+	}
+
+	return fmt.Sprintf("reply 0x%02x", reply)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestReqStringPartial(t *testing.T) {
+	for _, tc := range []struct {
+		req  Socks5_Req
+		want string
+	}{
+		{Socks5_Req{}, "cmd 0x00 <no destination>"},
+		{Socks5_Req{Cmd: CONNECT_cmd, AType: DOMAINNAME_addr, DstAddr: []byte("example.com")}, "CONNECT <no destination>"},
+		{Socks5_Req{Cmd: BIND_cmd, AType: IP_V4_addr, DstPort: []byte{0, 80}}, "BIND <no destination>"},
+		{Socks5_Req{Cmd: CONNECT_cmd, AType: DOMAINNAME_addr, DstAddr: []byte("example.com"), DstPort: []byte{1}}, "CONNECT <no destination>"},
+	} {
+		if got := fmt.Sprint(tc.req); got != tc.want {
+			t.Errorf("Sprint = %q, want %q", got, tc.want)
+		}
+	}
+
+	if got := (Socks5_Req{DstPort: []byte{1}}).PortNum(); got != 0 {
+		t.Fatalf("PortNum of a 1 byte DST.PORT = %d, want 0", got)
+	}
+}
+
+func TestNewBindResUnmapsIPv4(t *testing.T) {
+	res := newBindRes(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1080})
+
+	if res.AType != IP_V4_addr || res.BindAddr != "10.1.2.3" {
+		t.Fatalf("reply reports %d %s, want IPv4 10.1.2.3", res.AType, res.BindAddr)
+	}
+}
+
+func TestReqString(t *testing.T) {
+	req, _, err := ParseRequest(domainReq(CONNECT_cmd, "example.com", 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.String(); got != "CONNECT example.com:443" {
+		t.Fatalf("String = %q, want CONNECT example.com:443", got)
+	}
+}
+
+func TestReplyNames(t *testing.T) {
+	for _, tc := range []struct {
+		reply byte
+		want  string
+	}{
+		{SUCCEEDED_connReply, "succeeded"},
+		{GENERAL_SOCKS_SERVER_FAILURE_connReply, "general SOCKS server failure"},
+		{CONNECTION_NOT_ALLOWED_BY_RULESET_connReply, "connection not allowed by ruleset"},
+		{NETWORK_UNREACHABLE_connReply, "network unreachable"},
+		{HOST_UNREACHABLE_connReply, "host unreachable"},
+		{CONNECTION_REFUSED_connReply, "connection refused"},
+		{TTL_EXPIRED_connReply, "TTL expired"},
+		{COMMAND_NOT_SUPPORTED_connReply, "command not supported"},
+		{ADDRESS_TYPE_NOT_SUPPORTED_connReply, "address type not supported"},
+		{0x09, "reply 0x09"},
+		{0xff, "reply 0xff"},
+	} {
+		if got := replyName(tc.reply); got != tc.want {
+			t.Errorf("replyName(%d) = %q, want %q", tc.reply, got, tc.want)
+		}
+
+		res := newFailureRes(tc.reply)
+		if got, want := res.String(), tc.want+" 0.0.0.0:0"; got != want {
+			t.Errorf("String of reply %d = %q, want %q", tc.reply, got, want)
+		}
+	}
+
+	res := newBindRes(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080})
+	if got, want := res.String(), "succeeded [2001:db8::1]:1080"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestFullAddrBracketsIPv6(t *testing.T) {
+	req := Socks5_Req{AType: IP_V6_addr, DstAddr: net.ParseIP("2001:db8::1"), DstPort: []byte{0x01, 0xbb}}
+
+	if got := req.FullAddr(); got != "[2001:db8::1]:443" {
+		t.Fatalf("FullAddr = %q, want [2001:db8::1]:443", got)
+	}
+}
+
+func TestResEncode(t *testing.T) {
+	for _, tc := range []struct {
+		res  Socks5_Res
+		want []byte
+	}{
+		{newFailureRes(HOST_UNREACHABLE_connReply), []byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{
+			Socks5_Res{AType: IP_V6_addr, BindAddr: "::1", BindPort: 1080},
+			append(append([]byte{5, 0, 0, 4}, net.IPv6loopback...), 0x04, 0x38),
+		},
+		{Socks5_Res{AType: DOMAINNAME_addr, BindAddr: "a.b", BindPort: 80}, []byte{5, 0, 0, 3, 3, 'a', '.', 'b', 0, 80}},
+	} {
+		got, err := tc.res.Encode()
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("Encode(%s) = %v, %v, want %v", tc.res, got, err, tc.want)
+		}
+	}
+
+	for _, res := range []Socks5_Res{
+		{AType: 0x09},
+		{AType: IP_V4_addr, BindAddr: "::1"},
+		{AType: IP_V4_addr, BindAddr: "0.0.0.0", BindPort: 1 << 16},
+		{AType: DOMAINNAME_addr},
+	} {
+		if _, err := res.Encode(); err == nil {
+			t.Errorf("Encode(%+v) succeeded, want an error", res)
+		}
+	}
+}
+
+func TestReqEncodeRoundTrip(t *testing.T) {
+	for _, raw := range [][]byte{
+		domainReq(CONNECT_cmd, "example.com", 443),
+		ipReq(BIND_cmd, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80}),
+		ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv6loopback, Port: 53}),
+	} {
+		req, _, err := ParseRequest(raw)
+		if err != nil {
+			t.Fatalf("ParseRequest(%v): %v", raw, err)
+		}
+
+		if got, err := req.Encode(); err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("Encode(ParseRequest(%v)) = %v, %v", raw, got, err)
+		}
+	}
+}
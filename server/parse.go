@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"io"
+)
+
+// ParseMethods - parses the NMETHODS and METHODS fields of the version
+// identifier/method selection message (see `handleSOCKS5` for the wire
+// format) from the start of `b`. Returns the offered methods along with the
+// number of bytes consumed.
+//
+// If `b` is incomplete, io.ErrUnexpectedEOF is returned, so that the caller
+// can read more and retry. The returned methods never alias `b`.
+func ParseMethods(b []byte) ([]byte, int, error) {
+	if len(b) < 1 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	end := 1 + int(b[0])
+	if len(b) < end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	return append([]byte(nil), b[1:end]...), end, nil
+}
+
+// ParseRequest - parses a SOCKS request (see `readSockRequest` for the wire
+// format) from the start of `b`. Returns the request along with the number
+// of bytes it consumed.
+//
+// If `b` holds a valid but incomplete request, io.ErrUnexpectedEOF is
+// returned, so that the caller can read more and retry. The returned request
+// never aliases `b`.
+func ParseRequest(b []byte) (Socks5_Req, int, error) {
+	if len(b) < 4 {
+		return Socks5_Req{}, 0, io.ErrUnexpectedEOF
+	}
+
+	ver, cmd, rsv, atyp := b[0], b[1], b[2], b[3]
+
+	if ver != SOCKS5H_VERSION || rsv != RSV {
+		return Socks5_Req{}, 0, fmt.Errorf("%w: invalid version or rsv", ErrBadRequest)
+	}
+
+	if cmd < CONNECT_cmd || cmd > UDP_ASSOCIATE_cmd {
+		return Socks5_Req{}, 0, fmt.Errorf("%w: request cmd type is invalid", ErrBadRequest)
+	}
+
+	// offset and length of DST.ADDR
+	var offset, length int
+
+	switch atyp {
+	case IP_V4_addr:
+		offset, length = 4, 4
+	case DOMAINNAME_addr:
+		if len(b) < 5 {
+			return Socks5_Req{}, 0, io.ErrUnexpectedEOF
+		}
+		offset, length = 5, int(b[4])
+	case IP_V6_addr:
+		offset, length = 4, 16
+	default:
+		return Socks5_Req{}, 0, fmt.Errorf("%w: invalid atyp provided", ErrBadRequest)
+	}
+
+	end := offset + length + 2
+	if len(b) < end {
+		return Socks5_Req{}, 0, io.ErrUnexpectedEOF
+	}
+
+	return Socks5_Req{
+		Version: ver,
+		Cmd:     cmd,
+		AType:   atyp,
+		DstAddr: append([]byte(nil), b[offset:offset+length]...),
+		DstPort: append([]byte(nil), b[offset+length:end]...),
+	}, end, nil
+}
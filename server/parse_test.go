@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add(ipReq(CONNECT_cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}))
+	f.Add(ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv4zero}))
+	f.Add(ipReq(BIND_cmd, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}))
+	f.Add(domainReq(CONNECT_cmd, "example.com", 443))
+	f.Add(append(domainReq(CONNECT_cmd, "example.com", 443), "GET / HTTP/1.1"...))
+	f.Add([]byte{SOCKS5H_VERSION, CONNECT_cmd, RSV, DOMAINNAME_addr, 0, 0, 80})
+	f.Add([]byte{SOCKS5H_VERSION, CONNECT_cmd, RSV, DOMAINNAME_addr, 255, 'a'})
+	f.Add([]byte{SOCKS5H_VERSION, CONNECT_cmd, RSV, 0x02})
+	f.Add([]byte{SOCKS5H_VERSION, CONNECT_cmd})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, n, err := ParseRequest(b)
+		if err != nil {
+			if n != 0 {
+				t.Fatalf("consumed %d bytes along with error %v", n, err)
+			}
+			return
+		}
+
+		if n <= 0 || n > len(b) {
+			t.Fatalf("consumed %d bytes of %d", n, len(b))
+		}
+
+		// rendering a parsed request never fails
+		_ = req.String()
+
+		encoded, err := req.Encode()
+		if err != nil {
+			// the only request parsed but not encoded has an empty domain
+			if req.AType != DOMAINNAME_addr || len(req.DstAddr) != 0 {
+				t.Fatalf("encoding %v: %v", b[:n], err)
+			}
+			return
+		}
+
+		if !bytes.Equal(encoded, b[:n]) {
+			t.Fatalf("encoded %v, want the %v parsed", encoded, b[:n])
+		}
+
+		again, m, err := ParseRequest(encoded)
+		if err != nil || m != len(encoded) {
+			t.Fatalf("reparsing %v = %d, %v", encoded, m, err)
+		}
+
+		if again.Cmd != req.Cmd || again.AType != req.AType || !bytes.Equal(again.DstAddr, req.DstAddr) || !bytes.Equal(again.DstPort, req.DstPort) {
+			t.Fatalf("reparsed %+v, want %+v", again, req)
+		}
+	})
+}
+
+func FuzzParseMethods(f *testing.F) {
+	f.Add([]byte{1, NO_AUTHENTICATION_REQUIRED_method})
+	f.Add([]byte{2, NO_AUTHENTICATION_REQUIRED_method, USERNAME_PASSWORD_method})
+	f.Add([]byte{2, USERNAME_PASSWORD_method, NO_AUTHENTICATION_REQUIRED_method, SOCKS5H_VERSION, CONNECT_cmd})
+	f.Add([]byte{0})
+	f.Add([]byte{255, NO_AUTHENTICATION_REQUIRED_method})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		methods, n, err := ParseMethods(b)
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) || n != 0 || len(b) > 0 && len(b) > int(b[0]) {
+				t.Fatalf("ParseMethods(%v) = %d, %v", b, n, err)
+			}
+			return
+		}
+
+		if n > len(b) || n != 1+len(methods) || int(b[0]) != len(methods) {
+			t.Fatalf("ParseMethods(%v) = %v, %d", b, methods, n)
+		}
+
+		if !bytes.Equal(methods, b[1:n]) {
+			t.Fatalf("methods = %v, want %v", methods, b[1:n])
+		}
+
+		// the methods don't alias the input
+		if len(methods) > 0 {
+			methods[0]++
+			if methods[0] == b[1] {
+				t.Fatal("methods alias the input")
+			}
+		}
+	})
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errPeekUnsupported - the connection can't be peeked at on this platform
+var errPeekUnsupported = errors.New("peeking isn't supported")
+
+// peekRemote - recv(MSG_PEEK) isn't used on this platform, so the caller
+// reads from the connection instead
+func peekRemote(conn *net.TCPConn, wait time.Duration) error {
+	return errPeekUnsupported
+}
@@ -0,0 +1,58 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errPeekUnsupported - the connection can't be peeked at on this platform
+var errPeekUnsupported = errors.New("peeking isn't supported")
+
+// peekRemote - waits up to `wait` for the remote to send data or close the
+// connection with recv(MSG_PEEK), so that nothing is consumed and the
+// connection can still be spliced. Returns an error if the remote is gone.
+func peekRemote(conn *net.TCPConn, wait time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return errPeekUnsupported
+	}
+
+	if wait > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	var n int
+	var peekErr error
+	buf := make([]byte, 1)
+
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+
+		// nothing arrived yet: wait for it only if there's time to
+		pending := peekErr == syscall.EAGAIN || peekErr == syscall.EINTR
+		return !pending || wait <= 0
+	})
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case err != nil:
+		return err
+	case peekErr == syscall.EAGAIN || peekErr == syscall.EINTR:
+		return nil
+	case peekErr != nil:
+		return os.NewSyscallError("recvfrom", peekErr)
+	case n == 0:
+		return errRemoteClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDeniedByPolicy - a request is denied by a Policy without saying why
+var ErrDeniedByPolicy = errors.New("socks5h: request denied by policy")
+
+// Policy - decides whether a request may proceed, e.g. by evaluating it
+// against a policy engine. RuleSet is the built-in one.
+type Policy interface {
+	// Evaluate - decides on the request of the session, once the client has
+	// authenticated and the command is known to be supported. An error
+	// rejects the request with GENERAL_SOCKS_SERVER_FAILURE, failing closed.
+	// The destinations of UDP datagrams are evaluated too, as requests of
+	// the UDP_ASSOCIATE_cmd command; those denied are dropped.
+	Evaluate(ctx context.Context, sess *Session, req Socks5_Req) (Decision, error)
+}
+
+// Decision - the outcome of evaluating a request against a Policy
+type Decision struct {
+	// Allow - whether the request may proceed
+	Allow bool
+
+	// Reply - the reply code a denied request gets. Zero means
+	// CONNECTION_NOT_ALLOWED_BY_RULESET.
+	Reply byte
+
+	// Err - the error a denied request is reported with. Nil means
+	// ErrDeniedByPolicy.
+	Err error
+}
+
+// reply - returns the reply code of the denied request
+func (d Decision) reply() byte {
+	if d.Reply != SUCCEEDED_connReply {
+		return d.Reply
+	}
+
+	return CONNECTION_NOT_ALLOWED_BY_RULESET_connReply
+}
+
+// err - returns the error of the denied request
+func (d Decision) err() error {
+	if d.Err != nil {
+		return d.Err
+	}
+
+	return ErrDeniedByPolicy
+}
+
+// Request denial reasons, used as the "reason" of the request_denied event
+// and of MetricRequestDenied
+const (
+	// denyAuthorize - `Config.Authorize` rejected the request
+	denyAuthorize = "authorize"
+
+	// denyRules - the RuleSet denied the destination
+	denyRules = "rules"
+
+	// denyPolicy - `Config.Policy` denied the request
+	denyPolicy = "policy"
+
+	// denyLoop - the destination resolved to the server itself
+	denyLoop = "loop"
+)
+
+// requestDenied - emits the "request_denied" event of a request denied for
+// its destination, at warn level so that it can be told apart from other
+// failures and e.g. fed to a threat-intel pipeline, and counts it
+func (s *Server) requestDenied(ctx context.Context, sess *Session, req Socks5_Req, reason string, err error) {
+	s.cfg.metrics().Count(MetricRequestDenied, 1, map[string]string{"reason": reason})
+
+	s.logger(ctx).Warn("request_denied",
+		"client", sess.ClientAddr,
+		"user", sess.User,
+		"cmd", cmdName(req.Cmd),
+		"dst", req.FullAddr(),
+		"reason", reason,
+		"err", err,
+	)
+}
+
+// evaluatePolicies - evaluates the request against the current RuleSet, then
+// `Config.Policy`, stopping at the first denial. On denial the reply to send
+// is returned.
+func (s *Server) evaluatePolicies(ctx context.Context, sess *Session, req Socks5_Req) (Socks5_Res, error) {
+	policies := []Policy{s.rules.Load()}
+	if s.cfg.Policy != nil {
+		policies = append(policies, s.cfg.Policy)
+	}
+
+	for _, policy := range policies {
+		decision, err := policy.Evaluate(ctx, sess, req)
+		if err != nil {
+			return newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), fmt.Errorf("evaluating policy: %w", err)
+		}
+
+		if !decision.Allow {
+			reason := denyPolicy
+			if errors.Is(decision.err(), ErrDeniedByRules) {
+				reason = denyRules
+			}
+
+			s.requestDenied(ctx, sess, req, reason, decision.err())
+			return newFailureRes(decision.reply()), decision.err()
+		}
+	}
+
+	return newRes(), nil
+}
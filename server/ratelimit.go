@@ -0,0 +1,81 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// ipLimitersSweepSize - the number of tracked client IPs past which the
+// idle ones are swept
+const ipLimitersSweepSize = 4096
+
+// ipLimiter - a token bucket per client IP, refilled at `rate` tokens per
+// second up to `burst`
+type ipLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket - the tokens left to an IP as of `last`
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newIPLimiter - creates a limiter allowing `rate` events per second per IP,
+// with bursts of up to `burst`. Returns nil, allowing everything, if `rate`
+// isn't positive.
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &ipLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow - takes a token of the IP, returns false if it has none left
+func (l *ipLimiter) allow(ip string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= ipLimitersSweepSize {
+			l.sweep(now)
+		}
+
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sweep - forgets the IPs whose bucket has refilled, as a new bucket is the
+// same as a full one
+func (l *ipLimiter) sweep(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// prefixConn - a connection whose first reads return bytes that were already
+// read off the underlying connection
+type prefixConn struct {
+	wrappedConn
+	prefix []byte
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+
+	return p.Conn.Read(b)
+}
+
+// errRemoteClosed - the remote closed the connection before the reply
+var errRemoteClosed = errors.New("remote closed the connection")
+
+// checkRemote - waits up to `wait` for the remote to send data or close the
+// connection, a zero `wait` only looking at what already arrived. Returns an
+// error if the remote is already gone, otherwise the connection to use in
+// its place. TCP connections are peeked at, consuming nothing, and are
+// returned as is; others are read from, the connection returned keeping any
+// byte read meanwhile.
+func checkRemote(remote net.Conn, wait time.Duration) (net.Conn, error) {
+	if tc, ok := remote.(*net.TCPConn); ok {
+		if err := peekRemote(tc, wait); !errors.Is(err, errPeekUnsupported) {
+			return remote, err
+		}
+	}
+
+	if err := remote.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1)
+	n, err := remote.Read(b)
+
+	if err := remote.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	if n > 0 {
+		return &prefixConn{wrappedConn: wrappedConn{remote}, prefix: b[:n]}, nil
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return remote, nil
+	}
+
+	if err == nil || errors.Is(err, io.EOF) {
+		err = errRemoteClosed
+	}
+
+	return nil, err
+}
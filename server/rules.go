@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrDeniedByRules - the destination of a request is denied by the RuleSet
+var ErrDeniedByRules = errors.New("socks5h: destination denied by rules")
+
+// RuleSet - allow and deny lists of CONNECT and UDP datagram destinations,
+// the built-in Policy. A pattern is either
+// a host name, matched case-insensitively, a "*.example.com" wildcard,
+// matching the subdomains of example.com, an IP address or a CIDR block.
+// Domain patterns match domain requests only and IP patterns IP requests
+// only, as destinations are resolved after the rules are checked. A client
+// can thus reach a host whose name is denied by requesting its IP address
+// instead: deny its addresses too, or set `Config.RequireHostnames` so that
+// every request carries a name.
+type RuleSet struct {
+	// Allow - if not empty, only destinations matching one of these patterns
+	// are allowed
+	Allow []string
+
+	// Deny - destinations matching one of these patterns are denied, even if
+	// allowed by Allow
+	Deny []string
+}
+
+// check - returns ErrDeniedByRules if the destination of the request isn't
+// allowed
+func (r *RuleSet) check(req Socks5_Req) error {
+	if r == nil {
+		return nil
+	}
+
+	if len(r.Allow) > 0 && !matchAny(r.Allow, req) {
+		return ErrDeniedByRules
+	}
+
+	if matchAny(r.Deny, req) {
+		return ErrDeniedByRules
+	}
+
+	return nil
+}
+
+// Evaluate - denies CONNECT requests whose destination isn't allowed, with
+// ErrDeniedByRules. Other commands are always allowed.
+func (r *RuleSet) Evaluate(ctx context.Context, sess *Session, req Socks5_Req) (Decision, error) {
+	if req.Cmd != CONNECT_cmd {
+		return Decision{Allow: true}, nil
+	}
+
+	if err := r.check(req); err != nil {
+		return Decision{Err: err}, nil
+	}
+
+	return Decision{Allow: true}, nil
+}
+
+// UpdateRules - replaces the RuleSet checked for every CONNECT request.
+// Requests already being served, and their tunnels, are unaffected; only
+// the requests read afterwards see the new rules.
+func (s *Server) UpdateRules(rules RuleSet) {
+	s.rules.Store(&rules)
+}
+
+// matchAny - reports whether the destination of the request matches one of
+// the patterns
+func matchAny(patterns []string, req Socks5_Req) bool {
+	for _, pattern := range patterns {
+		if matchRule(pattern, req) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRule - reports whether the destination of the request matches the
+// pattern
+func matchRule(pattern string, req Socks5_Req) bool {
+	if req.AType != DOMAINNAME_addr {
+		ip := net.IP(req.DstAddr)
+
+		if _, block, err := net.ParseCIDR(pattern); err == nil {
+			return block.Contains(ip)
+		}
+
+		if patternIP := net.ParseIP(pattern); patternIP != nil {
+			return patternIP.Equal(ip)
+		}
+
+		return false
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(req.AddrStr()), ".")
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+
+	return host == pattern
+}
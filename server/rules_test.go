@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	domain := func(host string) Socks5_Req {
+		return Socks5_Req{AType: DOMAINNAME_addr, DstAddr: []byte(host)}
+	}
+	ip := func(addr string) Socks5_Req {
+		return Socks5_Req{AType: IP_V4_addr, DstAddr: net.ParseIP(addr).To4()}
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		req     Socks5_Req
+		want    bool
+	}{
+		{"example.com", domain("Example.COM."), true},
+		{"example.com", domain("www.example.com"), false},
+		{"*.example.com", domain("www.example.com"), true},
+		{"*.example.com", domain("example.com"), false},
+		{"10.0.0.0/8", ip("10.1.2.3"), true},
+		{"10.0.0.0/8", ip("192.168.0.1"), false},
+		{"192.168.0.1", ip("192.168.0.1"), true},
+		{"10.0.0.0/8", domain("10.1.2.3"), false},
+	} {
+		if got := matchRule(tc.pattern, tc.req); got != tc.want {
+			t.Errorf("matchRule(%q, %s) = %v, want %v", tc.pattern, tc.req.AddrStr(), got, tc.want)
+		}
+	}
+}
+
+func TestRulesDenyAndUpdate(t *testing.T) {
+	metrics := newTestMetrics()
+	echo := startEcho(t)
+	srv := startServer(t, Config{Metrics: metrics, Rules: &RuleSet{Deny: []string{"127.0.0.0/8"}}})
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, echo.(*net.TCPAddr)))
+	if reply := readReply(t, conn); reply.rep != CONNECTION_NOT_ALLOWED_BY_RULESET_connReply {
+		t.Fatalf("denied reply = %s, want not allowed", replyName(reply.rep))
+	}
+
+	if got := metrics.count(MetricRequestDenied, "reason", denyRules); got != 1 {
+		t.Fatalf("%s{reason=%s} = %d, want 1", MetricRequestDenied, denyRules, got)
+	}
+
+	srv.UpdateRules(RuleSet{})
+	connect(t, srv, echo)
+}
+
+func TestDomainRulesDontMatchIPLiterals(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+	cfg := Config{
+		Resolver: &staticResolver{addrs: []string{"127.0.0.1"}},
+		Rules:    &RuleSet{Deny: []string{"blocked.example.com"}},
+	}
+
+	denied := func(srv *Server) {
+		t.Helper()
+
+		conn := negotiate(t, srv)
+		write(t, conn, domainReq(CONNECT_cmd, "blocked.example.com", echo.Port))
+		if reply := readReply(t, conn); reply.rep != CONNECTION_NOT_ALLOWED_BY_RULESET_connReply {
+			t.Fatalf("domain reply = %s, want not allowed by ruleset", replyName(reply.rep))
+		}
+	}
+
+	// the address the denied name resolves to is still reachable
+	srv := startServer(t, cfg)
+	denied(srv)
+	connect(t, srv, echo)
+
+	// unless IP literals are rejected
+	cfg.RequireHostnames = true
+	srv = startServer(t, cfg)
+	denied(srv)
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(CONNECT_cmd, echo))
+	if reply := readReply(t, conn); reply.rep != ADDRESS_TYPE_NOT_SUPPORTED_connReply {
+		t.Fatalf("IP literal reply = %s, want address type not supported", replyName(reply.rep))
+	}
+}
+
+// replyPolicy - denies every request with its reply code
+type replyPolicy byte
+
+func (p replyPolicy) Evaluate(ctx context.Context, sess *Session, req Socks5_Req) (Decision, error) {
+	return Decision{Reply: byte(p)}, nil
+}
+
+func TestPolicyDenialReply(t *testing.T) {
+	srv := startServer(t, Config{Policy: replyPolicy(TTL_EXPIRED_connReply)})
+
+	conn := negotiate(t, srv)
+	write(t, conn, domainReq(CONNECT_cmd, "example.com", 443))
+
+	if reply := readReply(t, conn); reply.rep != TTL_EXPIRED_connReply {
+		t.Fatalf("reply = %s, want the policy's TTL expired", replyName(reply.rep))
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrSelfTest - the startup self-test failed, see `Config.SelfTestRequired`
+var ErrSelfTest = errors.New("socks5h: startup self-test failed")
+
+// selfTestTimeout - bounds the self-test when no dial timeout applies
+const selfTestTimeout = 10 * time.Second
+
+// selfTest - CONNECTs to `Config.SelfTestTarget` through the same path as a
+// client request would take, then logs the outcome. With
+// `Config.SelfTestRequired` a failure closes the listeners and is returned.
+func (s *Server) selfTest() error {
+	target := s.cfg.SelfTestTarget
+	if len(target) == 0 {
+		return nil
+	}
+
+	err := s.connectSelfTest(target)
+	if err == nil {
+		s.cfg.logger().Info("self-test passed", "target", target)
+		return nil
+	}
+
+	s.cfg.logger().Error("self-test failed", "target", target, "err", err)
+	if !s.cfg.SelfTestRequired {
+		return nil
+	}
+
+	s.mu.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+	s.mu.Unlock()
+
+	return fmt.Errorf("%w: %s: %w", ErrSelfTest, target, err)
+}
+
+// connectSelfTest - dials `target` ("host:port") with connectDst and closes
+// the connection right away
+func (s *Server) connectSelfTest(target string) error {
+	req, err := newConnectReq(target)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	sess := &Session{Method: NO_AUTHENTICATION_REQUIRED_method}
+
+	remote, _, err := s.connectDst(ctx, sess, req)
+	if err != nil {
+		return err
+	}
+
+	return remote.Close()
+}
+
+// newConnectReq - creates the CONNECT request a client would send for
+// `target` ("host:port")
+func newConnectReq(target string) (Socks5_Req, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return Socks5_Req{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Socks5_Req{}, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	req := Socks5_Req{
+		Version: SOCKS5H_VERSION,
+		Cmd:     CONNECT_cmd,
+		AType:   DOMAINNAME_addr,
+		DstAddr: []byte(host),
+		DstPort: binary.BigEndian.AppendUint16(nil, uint16(port)),
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		req.AType, req.DstAddr = IP_V6_addr, ip.To16()
+		if v4 := ip.To4(); v4 != nil {
+			req.AType, req.DstAddr = IP_V4_addr, v4
+		}
+	}
+
+	return req, nil
+}
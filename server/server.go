@@ -2,63 +2,586 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"runtime/debug"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
 	net_type = "tcp"
 	port     = ":1080"
+
+	// shutdownPollInterval - how often Shutdown checks for remaining tunnels
+	shutdownPollInterval = 50 * time.Millisecond
+
+	// defaultReplyLinger - how long to linger after a failure reply
+	defaultReplyLinger = 100 * time.Millisecond
+
+	// defaultDeferReplyTimeout - how long a deferred CONNECT reply is held
+	defaultDeferReplyTimeout = time.Second
+
+	// defaultTLSHandshakeTimeout - how long clients have to complete the TLS
+	// handshake
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	// proxyHandshakeTimeout - bounds the HTTP CONNECT exchange with the
+	// upstream proxy when no dial timeout is set
+	proxyHandshakeTimeout = 10 * time.Second
 )
 
+// ErrServerClosed - returned by ListenAndServe after a call to Shutdown
+var ErrServerClosed = errors.New("socks5h: server closed")
+
+// connState - the lifecycle phase of an accepted connection
+type connState int
+
+const (
+	// connDone - the connection is done tunneling and only left to be
+	// closed, so it can be closed at any time
+	connDone connState = iota
+
+	// connHandshake - the connection is still negotiating and carries no
+	// tunneled data, so it can be closed at any time
+	connHandshake
+
+	// connActive - the connection is tunneling data to a remote
+	connActive
+)
+
+// defaultMaxTrackedConns - the most connections the server keeps track of,
+// unless `Config.MaxTrackedConns` says otherwise
+const defaultMaxTrackedConns = 1 << 16
+
+// trackedConn - the registry entry of an accepted connection
+type trackedConn struct {
+	state connState
+
+	// doneAt - when the connection entered connDone
+	doneAt time.Time
+}
+
+// Server - a `socks5h://` proxy server
+type Server struct {
+	cfg Config
+
+	mu         sync.Mutex
+	listeners  []net.Listener
+	conns      map[net.Conn]*trackedConn
+	inShutdown atomic.Bool
+	ready      atomic.Bool
+
+	livenessChecks []func() error
+
+	// rules - the RuleSet checked for CONNECT requests, see UpdateRules
+	rules atomic.Pointer[RuleSet]
+
+	// authenticators - the registered authenticators, at most one per METHOD
+	authenticators []Authenticator
+
+	bindSlots *slots
+	udpSlots  *slots
+
+	// dialFailures - the negative dial cache, see `Config.DialFailureCooldown`
+	dialFailures *dialFailures
+
+	// lookups - the lookups in progress, see `Config.CoalesceLookups`
+	lookups *lookupGroup
+
+	// stats - the running totals of Stats
+	stats serverStats
+
+	// bandwidth - paces the tunnels of each client IP, see
+	// `Config.ClientBandwidth`
+	bandwidth *bandwidthLimiter
+
+	// handshakeLimiter - rate limits the connections of each client IP, see
+	// `Config.HandshakeRate`
+	handshakeLimiter *ipLimiter
+}
+
+// NewServer - creates a new server from the given config
+func NewServer(cfg Config) *Server {
+	s := &Server{
+		cfg:       cfg,
+		conns:     make(map[net.Conn]*trackedConn),
+		bindSlots: newSlots(cfg.MaxBindListeners),
+		udpSlots:  newSlots(cfg.MaxUDPAssociations),
+
+		dialFailures:     newDialFailures(),
+		lookups:          newLookupGroup(),
+		bandwidth:        newBandwidthLimiter(cfg.ClientBandwidth),
+		handshakeLimiter: newIPLimiter(cfg.HandshakeRate, cfg.HandshakeBurst),
+		authenticators:   orderAuthenticators(registerAuthenticators(cfg.authenticators()), cfg.MethodPreference),
+	}
+
+	if cfg.Rules != nil {
+		s.UpdateRules(*cfg.Rules)
+	}
+
+	return s
+}
+
 // Setup_SOCKS5H_Server - sets up the `socks5h://` server for proxy connections
 func Setup_SOCKS5H_Server() {
-	listener, err := net.Listen(net_type, port)
-	if err != nil {
+	srv := NewServer(Config{Addr: port})
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, ErrServerClosed) {
 		panic(err)
 	}
+}
 
-	fmt.Println("socks5h:// started on port", port)
+// Listen - creates a server and binds its listener, without serving yet. This
+// allows binding a privileged port and dropping the privileges before Serve
+// is called. The self-test of `Config.SelfTestTarget` runs once bound.
+func Listen(cfg Config) (*Server, error) {
+	s := NewServer(cfg)
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
 
-	for {
-		conn, err := listener.Accept()
+	if err := s.selfTest(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListenAndServe - listens on the configured address and serves incoming
+// connections until Shutdown is called, after which ErrServerClosed is
+// returned. The self-test of `Config.SelfTestTarget` runs before serving.
+func (s *Server) ListenAndServe() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+
+	if err := s.selfTest(); err != nil {
+		return err
+	}
+
+	return s.Serve()
+}
+
+// listen - binds a listener on each configured address. Either all of them
+// are bound or none.
+func (s *Server) listen() error {
+	if s.inShutdown.Load() {
+		return ErrServerClosed
+	}
+
+	lc := s.cfg.listenConfig()
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, addr := range s.cfg.addrs() {
+		listener, err := lc.Listen(context.Background(), net_type, addr)
 		if err != nil {
-			panic(err)
+			closeAll()
+			return listenError(addr, err)
+		}
+
+		if s.cfg.TLSConfig != nil {
+			listener = tls.NewListener(listener, s.cfg.tlsConfig())
 		}
 
+		listeners = append(listeners, listener)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		closeAll()
+		return ErrServerClosed
+	}
+
+	if len(s.listeners) > 0 {
+		closeAll()
+		return errors.New("socks5h: server is already listening")
+	}
+
+	s.listeners = listeners
+	return nil
+}
+
+// Addr - returns the address the server's (first) listener is bound to, e.g.
+// the actual port when listening on ":0". Nil until Listen or ListenAndServe
+// has bound the listener.
+func (s *Server) Addr() net.Addr {
+	if addrs := s.Addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+
+	return nil
+}
+
+// Addrs - returns the addresses of all the server's listeners, in the order
+// of `Config.ListenAddrs`
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+
+	return addrs
+}
+
+// Serve - accepts connections on the listeners bound by Listen until Shutdown
+// is called, after which ErrServerClosed is returned. Each listener has its
+// own accept loop; should one of them fail, all listeners are closed and its
+// error is returned.
+func (s *Server) Serve() error {
+	s.mu.Lock()
+	listeners := s.listeners
+	if len(listeners) > 0 && !s.inShutdown.Load() {
+		s.ready.Store(true)
+	}
+	s.mu.Unlock()
+
+	if len(listeners) == 0 {
+		return errors.New("socks5h: server isn't listening")
+	}
+
+	s.logStartup(listeners)
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
 		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					fmt.Printf("Recovered from panic: %v\nStack Trace:\n%s\n", r, debug.Stack())
-				}
-			}()
-
-			if err := handle_socks5_connection(conn, context.Background()); err != nil {
-				fmt.Println(err)
-			}
+			errs <- s.acceptLoop(listener)
 		}()
 	}
+
+	err := <-errs
+	if !errors.Is(err, ErrServerClosed) {
+		s.ready.Store(false)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	return err
+}
+
+// logStartup - logs the listen addresses along with the effective config,
+// defaults applied
+func (s *Server) logStartup(listeners []net.Listener) {
+	addrs := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	methods := make([]byte, 0, len(s.authenticators))
+	for _, auth := range s.authenticators {
+		methods = append(methods, auth.Method())
+	}
+
+	var allowRules, denyRules int
+	if rules := s.rules.Load(); rules != nil {
+		allowRules, denyRules = len(rules.Allow), len(rules.Deny)
+	}
+
+	upstream := ""
+	if s.cfg.UpstreamHTTPProxy != nil {
+		upstream = s.cfg.UpstreamHTTPProxy.Redacted()
+	}
+
+	s.cfg.logger().Info("socks5h:// started",
+		"addrs", addrs,
+		"methods", methodNames(methods),
+		"idle_timeout", s.cfg.IdleTimeout,
+		"dial_timeout", s.cfg.DialTimeout,
+		"methods_timeout", s.cfg.MethodsTimeout,
+		"auth_timeout", s.cfg.AuthTimeout,
+		"allow_rules", allowRules,
+		"deny_rules", denyRules,
+		"upstream_http_proxy", upstream,
+		"max_bind_listeners", s.cfg.MaxBindListeners,
+		"max_udp_associations", s.cfg.MaxUDPAssociations,
+		"max_tracked_conns", s.cfg.maxTrackedConns(),
+		"max_handshake_bytes", s.cfg.MaxHandshakeBytes,
+		"tls", s.cfg.TLSConfig != nil,
+		"dry_run", s.cfg.DryRun,
+	)
+}
+
+// acceptLoop - accepts connections on the listener and serves each of them
+// until the listener fails
+func (s *Server) acceptLoop(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		if ip := addrIP(conn.RemoteAddr()); !s.handshakeLimiter.allow(ip.String(), time.Now()) {
+			s.cfg.metrics().Count(MetricRateLimited, 1, nil)
+			conn.Close()
+			continue
+		}
+
+		if s.cfg.DebugTrace {
+			conn = newTraceConn(conn)
+		}
+
+		conn = newBufferedConn(conn, s.cfg.MaxHandshakeBytes)
+
+		if !s.trackConn(conn) {
+			conn.Close()
+			continue
+		}
+
+		go s.serveConn(withConnID(context.Background(), newConnID()), conn)
+	}
+}
+
+// serveConn - handles an accepted connection and logs how it ended. ctx
+// carries the ID the connection was given when accepted, see ConnID.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer s.untrackConn(conn)
+
+	logger := s.logger(ctx)
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("recovered from panic", "client", conn.RemoteAddr(), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	err := s.handle_socks5_connection(conn, ctx)
+	if err == nil {
+		return
+	}
+
+	if errors.Is(err, ErrEarlyDisconnect) {
+		logger.Debug(err.Error(), "client", conn.RemoteAddr())
+		return
+	}
+
+	logger.Error(err.Error(), "client", conn.RemoteAddr())
+
+	if trace, ok := findConn[*traceConn](conn); ok {
+		logger.Error("connection trace", "client", conn.RemoteAddr(), "trace", trace.Dump())
+	}
+}
+
+// Shutdown - gracefully shuts down the server, modeled after
+// http.Server.Shutdown. It stops accepting new connections, immediately
+// closes connections that are still in the handshake and then lets the
+// active tunnels drain: they keep relaying until they finish on their own,
+// so that transfers in flight complete. If ctx expires first, the remaining
+// tunnels are force-closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	s.ready.Store(false)
+
+	var errs []error
+	for _, listener := range s.listeners {
+		errs = append(errs, listener.Close())
+	}
+	s.mu.Unlock()
+
+	err := errors.Join(errs...)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	draining := s.closeConns(connHandshake)
+	if draining > 0 {
+		s.cfg.logger().Info("draining tunnels", "tunnels", draining)
+	}
+
+	for draining > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns(connActive)
+			s.cfg.logger().Warn("drain cut short, closed tunnels", "tunnels", draining, "err", ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		draining = s.closeConns(connHandshake)
+	}
+
+	return err
+}
+
+// trackConn - registers an accepted connection. Returns false if the server
+// is shutting down and the connection should be dropped. Once
+// `Config.MaxTrackedConns` are tracked, the connection done tunneling the
+// longest is closed and evicted first; if no connection is done, the new one
+// is dropped.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Load() {
+		return false
+	}
+
+	if limit := s.cfg.maxTrackedConns(); len(s.conns) >= limit {
+		if !s.evictDoneConn() {
+			s.trackedConnsOverflow(conn, "dropped", limit)
+			return false
+		}
+
+		s.trackedConnsOverflow(conn, "evicted", limit)
+	}
+
+	s.conns[conn] = &trackedConn{state: connHandshake}
+	s.stats.conns.Add(1)
+	return true
+}
+
+// evictDoneConn - closes and untracks the connection that has been done
+// tunneling the longest. Returns false if no connection is done. Must be
+// called with s.mu held.
+func (s *Server) evictDoneConn() bool {
+	var (
+		oldest net.Conn
+		doneAt time.Time
+	)
+
+	for conn, tracked := range s.conns {
+		if tracked.state == connDone && (oldest == nil || tracked.doneAt.Before(doneAt)) {
+			oldest, doneAt = conn, tracked.doneAt
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	oldest.Close()
+	delete(s.conns, oldest)
+	return true
+}
+
+// trackedConnsOverflow - logs and counts a connection accepted while
+// `Config.MaxTrackedConns` were tracked, `action` telling whether a done
+// connection was evicted for it or it was dropped
+func (s *Server) trackedConnsOverflow(conn net.Conn, action string, limit int) {
+	s.cfg.metrics().Count(MetricTrackedConnsOverflow, 1, map[string]string{"action": action})
+	s.cfg.logger().Warn("too many tracked connections",
+		"client", conn.RemoteAddr(),
+		"action", action,
+		"max_tracked_conns", limit,
+	)
+}
+
+// untrackConn - removes a finished connection from the server
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// setConnState - updates the lifecycle phase of a tracked connection
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tracked, ok := s.conns[conn]; ok {
+		tracked.state = state
+		if state == connDone {
+			tracked.doneAt = time.Now()
+		}
+	}
+}
+
+// closeConns - closes every tracked connection that is in a phase up to and
+// including `upTo`. Returns the number of connections left.
+func (s *Server) closeConns(upTo connState) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, tracked := range s.conns {
+		if tracked.state <= upTo {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+
+	return len(s.conns)
 }
 
 // handle_socks5_connection - handles a new incoming TCP connection.
 // Follows the guidelines of - https://datatracker.ietf.org/doc/html/rfc1927
-func handle_socks5_connection(conn net.Conn, ctx context.Context) error {
+func (s *Server) handle_socks5_connection(conn net.Conn, ctx context.Context) (err error) {
 	defer conn.Close()
 
+	// tell which client the error is about, keeping the phase it happened in
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("client %s: %w", conn.RemoteAddr(), err)
+		}
+	}()
+
+	if s.cfg.OnConnect != nil {
+		if err := s.cfg.OnConnect(ctx, newClientConn(conn)); err != nil {
+			return fmt.Errorf("on connect: %w", err)
+		}
+	}
+
+	// handshake explicitly, so that clients failing it, e.g. below
+	// MinTLSVersion, are told apart from those failing the SOCKS handshake
+	if tc, ok := findConn[*tls.Conn](conn); ok {
+		handshakeCtx, cancel := context.WithTimeout(ctx, s.cfg.tlsHandshakeTimeout())
+		err := tc.HandshakeContext(handshakeCtx)
+		cancel()
+
+		if err != nil {
+			return s.handshakeFailed(fmt.Errorf("%w: %w", ErrTLSHandshake, err))
+		}
+	}
+
 	version := make([]byte, 1)
 	if _, err := conn.Read(version); err != nil {
-		return err
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w: %w", ErrEarlyDisconnect, err)
+		}
+
+		return s.handshakeFailed(fmt.Errorf("reading version: %w", err))
 	}
 
 	if len(version) > 0 && version[0] == SOCKS5H_VERSION {
-		return handleSOCKS5(conn)
+		return s.handleSOCKS5(ctx, conn, newSession(conn))
+	}
+
+	if len(version) > 0 && version[0] == SOCKS4_VERSION && s.cfg.socks4Allowed() {
+		return s.handleSOCKS4(ctx, conn, newSession(conn))
 	}
 
-	return errors.New("non socks5h connection received")
+	if bc, ok := conn.(*bufferedConn); ok && s.cfg.RejectHTTPWithBanner && looksLikeHTTP(version[0], bc.buffered()) {
+		if writeHTTPBanner(conn) == nil {
+			lingerClose(conn, s.cfg.replyLinger())
+		}
+
+		return s.handshakeFailed(fmt.Errorf("%w: HTTP request", ErrBadVersion))
+	}
+
+	return s.handshakeFailed(ErrBadVersion)
 }
 
 // handleSOCKS5 - handles any SOCK 5 connection
@@ -75,50 +598,188 @@ func handle_socks5_connection(conn net.Conn, ctx context.Context) error {
 // The VER field is set to X'05' for this version of the protocol. The
 // NMETHODS field contains the number of method identifier octets that
 // appear in the METHODS field.
-func handleSOCKS5(conn net.Conn) error {
-	nmethods := make([]byte, 1)
-	if _, err := conn.Read(nmethods); err != nil {
-		return err
+func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, sess *Session) error {
+	methods, err := s.readMethods(conn, sess)
+	if err != nil {
+		return s.handshakeFailed(fmt.Errorf("reading methods: %w", err))
 	}
 
-	var methods []byte
-	if len(nmethods) > 0 && nmethods[0] > 0 {
-		methods = make([]byte, nmethods[0])
+	auth, err := s.replyMethodSelection(ctx, conn, methods)
+	if err != nil {
+		return s.handshakeFailed(fmt.Errorf("selecting method: %w", err))
+	}
 
-		if _, err := conn.Read(methods); err != nil {
-			return err
-		}
+	sess.Method = auth.Method()
+	if sess.User, sess.Metadata, err = s.authenticate(conn, auth); err != nil {
+		return s.handshakeFailed(fmt.Errorf("authenticating: %w", err))
 	}
 
-	if err := replyMethodSelection(conn, methods); err != nil {
-		return err
+	sess.Tenant = s.cfg.tenantFor(sess)
+
+	var tolerateRSV func(rsv byte)
+	if !s.cfg.strictRSV() {
+		tolerateRSV = func(rsv byte) {
+			s.logger(ctx).Warn("tolerating non-zero RSV", "client", sess.ClientAddr, "rsv", rsv)
+		}
 	}
 
-	req, err := readSockRequest(conn)
+	req, err := readSockRequest(conn, sess.scratch[:], tolerateRSV)
 	if err != nil {
-		return err
+		return s.handshakeFailed(fmt.Errorf("reading request: %w", err))
+	}
+
+	return s.serveRequest(ctx, conn, sess, req)
+}
+
+// serveRequest - replies to the request read off the client connection and
+// relays its traffic, whichever SOCKS version it came in
+func (s *Server) serveRequest(ctx context.Context, conn net.Conn, sess *Session, req Socks5_Req) error {
+	defer func() {
+		// the client is told about the failure before the panic goes on
+		if r := recover(); r != nil {
+			if sess.replyPending {
+				s.reply(conn, sess, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply))
+			}
+
+			panic(r)
+		}
+	}()
+
+	if bc, ok := conn.(*bufferedConn); ok {
+		bc.liftLimit()
+	}
+
+	sess.cmd = req.Cmd
+	sess.replyPending = true
+
+	remote, res, err := s.prepareProxy(ctx, conn, sess, req)
+	if err == nil && remote == nil && !s.cfg.DryRun {
+		res, err = newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("could not create remote connection")
 	}
 
-	remote, res, err := prepareProxy(req)
 	if err != nil {
-		return err
+		sess.replyPending = false
+		if !res.sent {
+			if s.reply(conn, sess, res) == nil {
+				lingerClose(conn, s.cfg.replyLinger())
+			}
+		}
+
+		return fmt.Errorf("preparing request %s: %w", req.FullAddr(), err)
 	}
 
+	sess.replyPending = false
 	if remote == nil {
-		return errors.New("could not create remote connection")
+		return s.replyDryRun(ctx, conn, sess, req, res)
 	}
 
-	if err := replyConnInfo(conn, res); err != nil {
-		return err
+	// whichever way the request ends from here on, the remote is closed;
+	// closing it again after the tunnel did is harmless
+	defer remote.Close()
+
+	if err := s.reply(conn, sess, res); err != nil {
+		return fmt.Errorf("replying: %w", err)
+	}
+
+	s.setConnState(conn, connActive)
+
+	if relay, ok := remote.(*udpRelay); ok {
+		err := s.relayUDP(ctx, conn, relay, sess)
+		s.setConnState(conn, connDone)
+		if err != nil {
+			return fmt.Errorf("relaying UDP: %w", err)
+		}
+
+		return nil
+	}
+
+	client := conn
+	if bc, ok := conn.(*bufferedConn); ok {
+		client = bc.detach()
+	}
+
+	for _, c := range []net.Conn{client, remote} {
+		if err := setNoDelay(c, s.cfg.tcpNoDelay()); err != nil {
+			return fmt.Errorf("setting TCP_NODELAY: %w", err)
+		}
+
+		if err := setBuffers(c, s.cfg.SocketReadBuffer, s.cfg.SocketWriteBuffer); err != nil {
+			return fmt.Errorf("setting socket buffers: %w", err)
+		}
+	}
+
+	if s.cfg.WrapStreams != nil {
+		client, remote = s.cfg.WrapStreams(req, client, remote)
+	}
+
+	client, release := s.bandwidth.limit(client)
+	defer release()
+
+	result := tunnel(client, remote, tunnelOptions{
+		idleTimeout: s.cfg.IdleTimeout,
+		kind:        s.cfg.streamHint(req),
+	})
+	s.setConnState(conn, connDone)
+	s.recordTunnel(ctx, sess, req, result)
+
+	if err := errors.Join(result.readErr, result.writeErr); err != nil {
+		return fmt.Errorf("tunneling %s: %w", req.FullAddr(), err)
 	}
 
-	if rErr, wErr := tunnel(conn, remote); rErr != nil || wErr != nil {
-		return fmt.Errorf("readError: %v\nwriteError: %v", rErr, wErr)
+	return nil
+}
+
+// replyDryRun - sends the reply of a request accepted in dry-run mode, logs
+// it and closes the connection, as there is nothing to relay
+func (s *Server) replyDryRun(ctx context.Context, conn net.Conn, sess *Session, req Socks5_Req, res Socks5_Res) error {
+	if err := s.reply(conn, sess, res); err != nil {
+		return fmt.Errorf("replying: %w", err)
 	}
 
+	s.logger(ctx).Info("dry run",
+		"client", sess.ClientAddr,
+		"user", sess.User,
+		"cmd", cmdName(req.Cmd),
+		"dst", req.FullAddr(),
+	)
+
+	lingerClose(conn, s.cfg.replyLinger())
 	return nil
 }
 
+// handshakeFailed - counts the failed handshake by its category and returns
+// the error
+func (s *Server) handshakeFailed(err error) error {
+	s.cfg.metrics().Count(MetricHandshakeFailed, 1, map[string]string{"reason": handshakeFailure(err)})
+	return err
+}
+
+// readMethods - reads the NMETHODS and METHODS fields sent by the client into
+// `scratch`, which must hold at least 256 bytes
+func readMethods(conn net.Conn, scratch []byte) ([]byte, error) {
+	wire := scratch[:1]
+	if _, err := io.ReadFull(conn, wire); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %w", ErrEarlyDisconnect, err)
+		}
+
+		return nil, err
+	}
+
+	wire = scratch[:1+int(wire[0])]
+	if n, err := io.ReadFull(conn, wire[1:]); err != nil {
+		// the client announced more methods than it sent
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: got %d of %d: %w", ErrShortMethods, n, wire[0], err)
+		}
+
+		return nil, err
+	}
+
+	methods, _, err := ParseMethods(wire)
+	return methods, err
+}
+
 // replyMethodSelection - performs method negotiaions and sub-negotiations.
 //
 // The server selects from one of the methods given in METHODS, and
@@ -142,23 +803,133 @@ func handleSOCKS5(conn net.Conn) error {
 //	o  X'FF' NO ACCEPTABLE METHODS
 //
 // The client and server then enter a method-specific sub-negotiation.
-func replyMethodSelection(conn net.Conn, methods []byte) error {
+//
+// The selected authenticator (see `selectAuthenticator`) is returned so that
+// its sub-negotiation can be run. When X'FF' is sent, the offered methods and
+// why none matched are logged at debug level. Selecting one of
+// `Config.DeprecatedMethods` is logged at warn level.
+func (s *Server) replyMethodSelection(ctx context.Context, conn net.Conn, methods []byte) (Authenticator, error) {
 	// set reply to no acceptable methods (X'FF) avaiable by default
 	reply := []byte{SOCKS5H_VERSION, NO_ACCEPTABLE_METHODS_method}
 
-	// Select no auth required method (X'00) if applicable
-	if slices.Contains(methods, NO_AUTHENTICATION_REQUIRED_method) {
-		reply[1] = NO_AUTHENTICATION_REQUIRED_method
+	selected, reason := s.selectAuthenticator(conn.RemoteAddr(), methods)
+	if selected != nil {
+		reply[1] = selected.Method()
+
+		if slices.Contains(s.cfg.DeprecatedMethods, reply[1]) {
+			s.logger(ctx).Warn("deprecated method selected",
+				"client", conn.RemoteAddr(),
+				"method", methodName(reply[1]),
+			)
+		}
+	} else {
+		s.logger(ctx).Debug("no acceptable methods",
+			"client", conn.RemoteAddr(),
+			"offered", methodNames(methods),
+			"reason", reason,
+		)
 	}
 
-	// TODO: handle GSSAPI and USERNAME/PASSWORD auth methods
+	// TODO: handle GSSAPI auth method
+
+	s.cfg.metrics().Count(MetricMethodSelected, 1, map[string]string{"method": methodName(reply[1])})
 
 	if _, err := conn.Write(reply); err != nil {
-		return err
+		return nil, err
 	}
 
-	// TODO: handle method sub-negotiations if required
-	return nil
+	if selected == nil {
+		return nil, ErrNoAcceptableMethods
+	}
+
+	return selected, nil
+}
+
+// readMethods - reads the methods offered by the client, bounded by
+// `Config.MethodsTimeout`
+func (s *Server) readMethods(conn net.Conn, sess *Session) ([]byte, error) {
+	if s.cfg.MethodsTimeout <= 0 {
+		return readMethods(conn, sess.scratch[:])
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(s.cfg.MethodsTimeout)); err != nil {
+		return nil, err
+	}
+
+	methods, err := readMethods(conn, sess.scratch[:])
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("%w after %s: %w", ErrMethodsTimeout, s.cfg.MethodsTimeout, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return methods, conn.SetReadDeadline(time.Time{})
+}
+
+// authenticate - runs the sub-negotiation of the authenticator, bounded by
+// `Config.AuthTimeout`
+func (s *Server) authenticate(conn net.Conn, auth Authenticator) (string, map[string]string, error) {
+	if s.cfg.AuthTimeout <= 0 {
+		return auth.Authenticate(conn)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(s.cfg.AuthTimeout)); err != nil {
+		return "", nil, err
+	}
+
+	user, metadata, err := auth.Authenticate(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "", nil, fmt.Errorf("%w after %s: %w", ErrAuthTimeout, s.cfg.AuthTimeout, err)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return user, metadata, conn.SetDeadline(time.Time{})
+}
+
+// selectAuthenticator - picks the authenticator for one of the methods offered
+// by the client, or nil if none is acceptable along with the reason why. By
+// default it's the first configured authenticator the client offered;
+// `Config.SelectMethod` overrides the choice, which still has to be both
+// offered and configured.
+func (s *Server) selectAuthenticator(clientAddr net.Addr, offered []byte) (Authenticator, string) {
+	auths := s.authenticators
+
+	if s.cfg.SelectMethod == nil {
+		for _, auth := range auths {
+			if slices.Contains(offered, auth.Method()) {
+				return auth, ""
+			}
+		}
+
+		accepted := make([]byte, 0, len(auths))
+		for _, auth := range auths {
+			accepted = append(accepted, auth.Method())
+		}
+
+		return nil, fmt.Sprintf("server only accepts %s", methodNames(accepted))
+	}
+
+	method := s.cfg.SelectMethod(clientAddr, offered)
+	if method == NO_ACCEPTABLE_METHODS_method {
+		return nil, "rejected by SelectMethod"
+	}
+
+	if !slices.Contains(offered, method) {
+		return nil, fmt.Sprintf("SelectMethod picked %s which the client didn't offer", methodName(method))
+	}
+
+	for _, auth := range auths {
+		if auth.Method() == method {
+			return auth, ""
+		}
+	}
+
+	return nil, fmt.Sprintf("SelectMethod picked %s which has no authenticator", methodName(method))
 }
 
 // readSockRequest - reads the socks5 request from the client
@@ -188,61 +959,110 @@ func replyMethodSelection(conn net.Conn, methods []byte) error {
 // The SOCKS server will typically evaluate the request based on source
 // and destination addresses, and return one or more reply messages, as
 // appropriate for the request type.
-func readSockRequest(conn net.Conn) (Socks5_Req, error) {
+//
+// The request is read into `scratch`, which must hold at least
+// handshakeScratchSize bytes. When `tolerateRSV` is set, a non-zero RSV is
+// passed to it and the request read on, instead of rejected.
+func readSockRequest(conn net.Conn, scratch []byte, tolerateRSV func(rsv byte)) (Socks5_Req, error) {
 	// ---------------- READ Reqeust Header
-	header := make([]byte, 4)
-	if readLen, err := conn.Read(header); err != nil {
+	header := scratch[:4]
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return Socks5_Req{}, err
-	} else if readLen != 4 {
-		return Socks5_Req{}, errors.New("ver to aytp in socks5h request isn't of length 4")
 	}
 
-	ver, cmd, rsv, atyp := header[0], header[1], header[2], header[3]
-
-	if ver != SOCKS5H_VERSION || rsv != RSV {
-		return Socks5_Req{}, errors.New("invalid version or rsv")
+	if rsv := header[2]; rsv != RSV && tolerateRSV != nil {
+		tolerateRSV(rsv)
+		header[2] = RSV
 	}
 
-	if cmd < CONNECT_cmd || cmd > UDP_ASSOCIATE_cmd {
-		return Socks5_Req{}, errors.New("request cmd type is invalid")
+	// validate the header before reading any further
+	if _, _, err := ParseRequest(header); !errors.Is(err, io.ErrUnexpectedEOF) {
+		return Socks5_Req{}, err
 	}
 
 	// ---------------- READ Address and Port
 	var addr, port []byte
 	var err error
 
-	switch atyp {
+	// the address and port are read right after the header, so that the
+	// whole request ends up in `scratch`
+	size := len(header)
+	rest := scratch[size:]
+
+	switch header[3] {
 	case IP_V4_addr:
-		addr, port, err = readIPV4Addr(conn)
+		addr, port, err = readIPV4Addr(conn, rest)
 	case DOMAINNAME_addr:
-		addr, port, err = readDomainNameAddr(conn)
+		addr, port, err = readDomainNameAddr(conn, rest)
+		size++
 	case IP_V6_addr:
-		addr, port, err = readIPV6Addr(conn)
-	default:
-		err = errors.New("invalid atyp provided")
+		addr, port, err = readIPV6Addr(conn, rest)
 	}
 
 	if err != nil {
 		return Socks5_Req{}, err
 	}
 
-	return Socks5_Req{
-		Version: ver,
-		Cmd:     cmd,
-		AType:   atyp,
-		DstAddr: addr,
-		DstPort: port,
-	}, nil
+	size += len(addr) + len(port)
+
+	req, _, err := ParseRequest(scratch[:size])
+	return req, err
 }
 
-func prepareProxy(req Socks5_Req) (net.Conn, Socks5_Res, error) {
-	if req.Cmd == CONNECT_cmd {
-		return connectDst(req)
+// prepareProxy - evaluates the request on behalf of the session's
+// authenticated user and sets up the proxy for its command. On failure the
+// returned reply holds the error code to send to the client. In dry-run mode
+// a request passing the checks gets a success reply with no remote
+// connection. Requests read once the server is shutting down get
+// GENERAL_SOCKS_SERVER_FAILURE.
+func (s *Server) prepareProxy(ctx context.Context, conn net.Conn, sess *Session, req Socks5_Req) (net.Conn, Socks5_Res, error) {
+	if s.inShutdown.Load() {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), ErrServerClosed
+	}
+
+	if !s.cfg.commandAllowed(req.Cmd) {
+		return nil, newFailureRes(COMMAND_NOT_SUPPORTED_connReply), fmt.Errorf("%s isn't allowed", cmdName(req.Cmd))
 	}
 
-	// TODO handle for BIND and UDP associate
+	if s.cfg.Authorize != nil {
+		if err := s.cfg.Authorize(ctx, newClientConn(conn), sess.User, req); err != nil {
+			s.requestDenied(ctx, sess, req, denyAuthorize, err)
+			return nil, newFailureRes(CONNECTION_NOT_ALLOWED_BY_RULESET_connReply), err
+		}
+	}
 
-	return nil, Socks5_Res{}, nil
+	switch req.Cmd {
+	case CONNECT_cmd:
+		// unlike UDP ASSOCIATE and BIND, where a zero DST.PORT means the
+		// client doesn't know it yet, there's nothing to CONNECT to on port 0
+		if req.PortNum() == 0 {
+			return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("destination port is zero")
+		}
+
+		if s.cfg.RequireHostnames && req.AType != DOMAINNAME_addr {
+			return nil, newFailureRes(ADDRESS_TYPE_NOT_SUPPORTED_connReply), errors.New("IP literal destinations aren't allowed")
+		}
+	case BIND_cmd, UDP_ASSOCIATE_cmd:
+	default:
+		return nil, newFailureRes(COMMAND_NOT_SUPPORTED_connReply), errors.New("request cmd isn't supported")
+	}
+
+	if res, err := s.evaluatePolicies(ctx, sess, req); err != nil {
+		return nil, res, err
+	}
+
+	if s.cfg.DryRun {
+		return nil, newRes(), nil
+	}
+
+	switch req.Cmd {
+	case CONNECT_cmd:
+		return s.connectDst(ctx, sess, req)
+	case BIND_cmd:
+		return s.bindDst(ctx, conn, sess, req)
+	}
+
+	return s.udpAssociate(conn, sess, req)
 }
 
 // connectDst - In the reply to a CONNECT (refer `replyConnInfo`), BND.PORT
@@ -252,33 +1072,120 @@ func prepareProxy(req Socks5_Req) (net.Conn, Socks5_Res, error) {
 // reach the SOCKS server, since such servers are often multi-homed.  It is
 // expected that the SOCKS server will use DST.ADDR and DST.PORT, and the
 // client-side source address and port in evaluating the CONNECT request.
-func connectDst(req Socks5_Req) (remote net.Conn, res Socks5_Res, err error) {
+//
+// The outbound network is taken from `Config.OutboundNetwork` when set,
+// overriding the per-address selection.
+//
+// A remote that is already gone by the time the reply would be sent is
+// reported as HOST_UNREACHABLE rather than succeeding and failing right away.
+// With `Config.DeferReplyUntilConnected` the reply waits for the remote to
+// speak first.
+func (s *Server) connectDst(ctx context.Context, sess *Session, req Socks5_Req) (net.Conn, Socks5_Res, error) {
+	if timeout := s.cfg.dialTimeout(req); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	switch req.AType {
-	case DOMAINNAME_addr:
-		remote, err = net.Dial(TCP_V4, req.FullAddr())
-		if err == nil {
-			res.Reply = SUCCEEDED_connReply
-		}
-	default:
-		res.Reply = ADDRESS_TYPE_NOT_SUPPORTED_connReply
+	start := time.Now()
+	dest := req.FullAddr()
+	cooldown := s.cfg.DialFailureCooldown
+
+	if cooldown > 0 && s.dialFailures.coolingDown(dest, start) {
+		return nil, newFailureRes(HOST_UNREACHABLE_connReply), fmt.Errorf("%w: %s", ErrDialCooldown, dest)
+	}
+
+	var remote net.Conn
+	var reply byte
+	var err error
+
+	if s.cfg.UpstreamHTTPProxy != nil {
+		remote, reply, err = s.dialHTTPProxy(ctx, s.cfg.UpstreamHTTPProxy, req)
+	} else {
+		remote, reply, err = s.dialDomain(ctx, req, sess.ClientAddr)
+	}
+	s.observeDial(ctx, start, dest, err)
+
+	// neither a loop nor a client giving up says anything about the
+	// destination
+	if cooldown > 0 && !errors.Is(err, ErrLoop) && !errors.Is(err, context.Canceled) {
+		s.dialFailures.record(dest, err != nil, time.Now(), s.cfg.dialFailureThreshold(), s.cfg.dialFailureWindow(), cooldown)
 	}
 
-	localAddr := remote.LocalAddr().(*net.TCPAddr)
-	if remote != nil {
-		if v4 := localAddr.IP.To4(); v4 != nil {
-			res.AType = IP_V4_addr
-		} else if v6 := localAddr.IP.To16(); v6 != nil {
-			res.AType = IP_V6_addr
-		} else {
-			res.AType = DOMAINNAME_addr
+	if errors.Is(err, ErrLoop) {
+		s.requestDenied(ctx, sess, req, denyLoop, err)
+	}
+
+	if err != nil {
+		return nil, newFailureRes(reply), err
+	}
+
+	checked, err := checkRemote(remote, s.cfg.remoteCheckWait())
+	if err != nil {
+		remote.Close()
+		return nil, newFailureRes(HOST_UNREACHABLE_connReply), fmt.Errorf("remote closed before reply: %w", err)
+	}
+
+	if s.cfg.PostDial != nil {
+		wrapped, err := s.cfg.PostDial(req, s.cfg.serverName(req), checked)
+		if err != nil {
+			checked.Close()
+			return nil, newFailureRes(dialErrorReply(err)), fmt.Errorf("post dial: %w", err)
 		}
 
-		res.BindAddr = localAddr.IP.String()
-		res.BindPort = localAddr.Port
+		checked = wrapped
+	}
+
+	sess.egress = egressOf(remote.LocalAddr())
+	return checked, newBindRes(remote.LocalAddr()), nil
+}
+
+// dialErrorReply - maps a dial error to the reply code reported to the client
+func dialErrorReply(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CONNECTION_REFUSED_connReply
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NETWORK_UNREACHABLE_connReply
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return HOST_UNREACHABLE_connReply
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TTL_EXPIRED_connReply
+	}
+
+	return GENERAL_SOCKS_SERVER_FAILURE_connReply
+}
+
+// errExtraReply - a reply would go over the count of the command
+var errExtraReply = errors.New("socks5h: reply over the count of the command")
+
+// maxReplies - returns the number of replies a request gets: two for BIND,
+// the second one once the incoming connection is accepted, and one for the
+// other commands
+func maxReplies(cmd byte) int {
+	if cmd == BIND_cmd {
+		return 2
+	}
+
+	return 1
+}
+
+// reply - sends a reply to the request of the session, refusing to send more
+// than its command gets, as an extra reply would desync the client
+func (s *Server) reply(conn net.Conn, sess *Session, res Socks5_Res) error {
+	if sess.replies >= maxReplies(sess.cmd) {
+		return fmt.Errorf("%w: %s after %d", errExtraReply, res, sess.replies)
+	}
+
+	sess.replies++
+	if sess.socks4 {
+		return replySOCKS4(conn, res)
 	}
 
-	return
+	return replyConnInfo(conn, res)
 }
 
 // replyConnInfo - The server evaluates the request, and returns a reply formed
@@ -317,9 +1224,10 @@ func connectDst(req Socks5_Req) (remote net.Conn, res Socks5_Res, err error) {
 // authentication, integrity and/or confidentiality, the replies are
 // encapsulated in the method-dependent encapsulation.
 func replyConnInfo(conn net.Conn, res Socks5_Res) error {
-	reply := []byte{SOCKS5H_VERSION, res.Reply, RSV, res.AType}
-	reply = append(reply, res.AddrBytes()...)
-	reply = append(reply, res.PortBytes()...)
+	reply, err := res.Encode()
+	if err != nil {
+		return fmt.Errorf("encoding reply: %w", err)
+	}
 
 	wLen, err := conn.Write(reply)
 
@@ -334,84 +1242,56 @@ func replyConnInfo(conn net.Conn, res Socks5_Res) error {
 	return nil
 }
 
-// readIPV4Addr - reads the IPv4 address sent in the address request
-func readIPV4Addr(conn net.Conn) (ipv4 []byte, port []byte, err error) {
-	ipv4 = make([]byte, 4)
-	port = make([]byte, 2)
-
-	if readLen, err := conn.Read(ipv4); err != nil {
-		return nil, nil, err
-	} else if readLen != 4 {
-		return nil, nil, errors.New("unable to ipv4")
+// lingerClose - half-closes the connection after a failure reply and drains
+// the client's input for up to `linger`. Closing with unread input would
+// reset the connection, which can make the client lose the reply.
+func lingerClose(conn net.Conn, linger time.Duration) {
+	if linger <= 0 {
+		return
 	}
 
-	if readLen, err := conn.Read(port); err != nil {
-		return nil, nil, err
-	} else if readLen != 2 {
-		return nil, nil, errors.New("unable to ipv4 port")
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
 	}
 
-	return
+	conn.SetReadDeadline(time.Now().Add(linger))
+	io.Copy(io.Discard, conn)
+}
+
+// readIPV4Addr - reads the IPv4 address sent in the address request
+func readIPV4Addr(conn net.Conn, buf []byte) (ipv4 []byte, port []byte, err error) {
+	return readAddrPort(conn, buf, 4)
 }
 
 // readDomainNameAddr - reads the domain name sent in the address request
-func readDomainNameAddr(conn net.Conn) (
+func readDomainNameAddr(conn net.Conn, buf []byte) (
 	domainName []byte,
 	port []byte,
 	err error,
 ) {
 	// to hold the length of the domain name
-	length := make([]byte, 1)
-
-	if readLen, err := conn.Read(length); err != nil {
-		return nil, nil, err
-	} else if readLen != 1 {
-		return nil, nil, errors.New("unable to read domain name length")
-	}
+	length := buf[:1]
 
-	domainName = make([]byte, length[0])
-	port = make([]byte, 2)
-
-	if readLen, err := conn.Read(domainName); err != nil {
-		return nil, nil, err
-	} else if readLen != int(length[0]) {
-		return nil, nil, errors.New("unable to domain name")
-	}
-
-	if readLen, err := conn.Read(port); err != nil {
+	if _, err := io.ReadFull(conn, length); err != nil {
 		return nil, nil, err
-	} else if readLen != 2 {
-		return nil, nil, errors.New("unable to domain name port")
 	}
 
-	return
+	return readAddrPort(conn, buf[1:], int(length[0]))
 }
 
 // readIPV6Addr - reads the IPv6 address in the address request
-func readIPV6Addr(conn net.Conn) (ipv6 []byte, port []byte, err error) {
-	ipv6 = make([]byte, 16)
-	port = make([]byte, 2)
-
-	if readLen, err := conn.Read(ipv6); err != nil {
-		return nil, nil, err
-	} else if readLen != 16 {
-		return nil, nil, errors.New("unable to ipv6")
-	}
+func readIPV6Addr(conn net.Conn, buf []byte) (ipv6 []byte, port []byte, err error) {
+	return readAddrPort(conn, buf, 16)
+}
 
-	if readLen, err := conn.Read(port); err != nil {
+// readAddrPort - reads an address of `addrLen` bytes followed by the 2 port
+// bytes into `buf`. Both are read at once, as a single read when they arrive
+// together.
+func readAddrPort(conn net.Conn, buf []byte, addrLen int) (addr []byte, port []byte, err error) {
+	buf = buf[:addrLen+2]
+	if _, err := io.ReadFull(conn, buf); err != nil {
 		return nil, nil, err
-	} else if readLen != 2 {
-		return nil, nil, errors.New("unable to ipv6 port")
 	}
 
-	return
-}
-
-func tunnel(client, remote net.Conn) (readErr, writeErr error) {
-	go func() {
-		_, writeErr = io.Copy(remote, client)
-	}()
-	_, readErr = io.Copy(client, remote)
-
-	return
+	return buf[:addrLen], buf[addrLen:], nil
 }
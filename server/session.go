@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Session - per-connection state that flows through the handler pipeline,
+// from the method negotiation down to dialing the destination
+type Session struct {
+	// ClientAddr - the remote address of the client connection
+	ClientAddr net.Addr
+
+	// Method - the negotiated authentication METHOD
+	Method byte
+
+	// User - the authenticated username, empty for methods without one. It
+	// is handed to `Config.Authorize`, Policy and TenantFor and written to
+	// the access log.
+	User string
+
+	// Ident - the USERID of a SOCKS4 request (see `Config.AllowSOCKS4`),
+	// which clients may use as a routing tag. Nothing vouches for it, so it
+	// is kept apart from User. It is written to the access log, and
+	// `Config.Authorize` gets it with Ident(ctx).
+	Ident string
+
+	// Metadata - the key/values the authenticator returned about the client,
+	// if any
+	Metadata map[string]string
+
+	// TLS - the state of the TLS connection the client speaks SOCKS over,
+	// see `Config.TLSConfig`. Nil for plain connections.
+	TLS *tls.ConnectionState
+
+	// Tenant - the tenant the connection is accounted to, see
+	// `Config.TenantFor`
+	Tenant string
+
+	// egress - the local IP CONNECT reached the destination from, see
+	// `egressOf`
+	egress string
+
+	// replyPending - set while the client waits for a reply to its request
+	replyPending bool
+
+	// cmd - the CMD of the request, once read
+	cmd byte
+
+	// socks4 - set when the client speaks SOCKS4, its replies being sent in
+	// the SOCKS4 format
+	socks4 bool
+
+	// replies - the replies sent to the request, see `Server.reply`
+	replies int
+
+	// scratch - the buffer the methods and the request are read into, so
+	// that the reads of a handshake don't each allocate. The parsed values
+	// never alias it.
+	scratch [handshakeScratchSize]byte
+}
+
+// handshakeScratchSize - the size of the largest message read into the
+// session scratch buffer: a request with a 255 bytes domain name
+const handshakeScratchSize = 4 + 1 + 255 + 2
+
+// newSession - creates the session for an accepted client connection, once
+// its TLS handshake, if any, is done
+func newSession(conn net.Conn) *Session {
+	sess := &Session{
+		ClientAddr: conn.RemoteAddr(),
+		Method:     NO_ACCEPTABLE_METHODS_method,
+	}
+
+	if tc, ok := findConn[*tls.Conn](conn); ok {
+		state := tc.ConnectionState()
+		sess.TLS = &state
+	}
+
+	return sess
+}
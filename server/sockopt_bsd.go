@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import "syscall"
+
+// soReusePort - SO_REUSEPORT
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package server
+
+// soReusePort - SO_REUSEPORT, which the frozen syscall package lacks on linux
+const soReusePort = 0x200
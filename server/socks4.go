@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+)
+
+// SOCKS4 Replies, sent with a VN of X'00'
+const (
+	// SOCKS4_GRANTED_reply - 90: request granted
+	SOCKS4_GRANTED_reply = 90
+
+	// SOCKS4_REJECTED_reply - 91: request rejected or failed
+	SOCKS4_REJECTED_reply = 91
+)
+
+// identKey - the context key of the SOCKS4 USERID
+type identKey struct{}
+
+// Ident - returns the USERID the SOCKS4 client sent, from the context handed
+// to `Config.Authorize`. Empty for SOCKS5 clients. See `Session.Ident`.
+func Ident(ctx context.Context) string {
+	ident, _ := ctx.Value(identKey{}).(string)
+	return ident
+}
+
+// handleSOCKS4 - handles a SOCKS4 or SOCKS4a connection, see
+// `Config.AllowSOCKS4`. There is no method negotiation: the client sends its
+// request right away, identifying itself with the USERID, which is kept as
+// the session's Ident rather than an authenticated User.
+func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, sess *Session) error {
+	sess.socks4 = true
+	sess.Method = NO_AUTHENTICATION_REQUIRED_method
+
+	req, ident, err := readSOCKS4Request(conn, sess.scratch[:])
+	if err != nil {
+		return s.handshakeFailed(fmt.Errorf("reading SOCKS4 request: %w", err))
+	}
+
+	sess.Ident = ident
+	sess.Tenant = s.cfg.tenantFor(sess)
+
+	return s.serveRequest(context.WithValue(ctx, identKey{}, ident), conn, sess, req)
+}
+
+// readSOCKS4Request - reads the request of a SOCKS4 client once VN was read.
+// Returns it along with the USERID.
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	  1    1      2              4           variable       1
+//
+// CD is 1 for CONNECT and 2 for BIND. With SOCKS4a, a DSTIP of 0.0.0.x, x
+// being non-zero, is followed by the domain name to resolve, also
+// NUL-terminated.
+//
+// The request is read into `scratch`, which must hold at least
+// handshakeScratchSize bytes.
+func readSOCKS4Request(conn net.Conn, scratch []byte) (Socks5_Req, string, error) {
+	header := scratch[:7]
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return Socks5_Req{}, "", err
+	}
+
+	cmd, port, ip := header[0], header[1:3], header[3:7]
+
+	if cmd != CONNECT_cmd && cmd != BIND_cmd {
+		return Socks5_Req{}, "", fmt.Errorf("%w: SOCKS4 request cmd type is invalid", ErrBadRequest)
+	}
+
+	user, err := readNulString(conn, scratch[7:])
+	if err != nil {
+		return Socks5_Req{}, "", fmt.Errorf("reading USERID: %w", err)
+	}
+
+	req := Socks5_Req{
+		Version: SOCKS4_VERSION,
+		Cmd:     cmd,
+		AType:   IP_V4_addr,
+		DstAddr: bytes.Clone(ip),
+		DstPort: bytes.Clone(port),
+	}
+
+	// SOCKS4a
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readNulString(conn, scratch[7:])
+		if err != nil {
+			return Socks5_Req{}, "", fmt.Errorf("reading SOCKS4a host: %w", err)
+		}
+
+		if len(host) == 0 {
+			return Socks5_Req{}, "", fmt.Errorf("%w: empty SOCKS4a host", ErrBadRequest)
+		}
+
+		req.AType = DOMAINNAME_addr
+		req.DstAddr = []byte(host)
+	}
+
+	return req, user, nil
+}
+
+// readNulString - reads a NUL-terminated string into `buf`, which bounds its
+// length. Returns the string without the NUL, not aliasing `buf`.
+func readNulString(conn net.Conn, buf []byte) (string, error) {
+	for i := range buf {
+		if _, err := io.ReadFull(conn, buf[i:i+1]); err != nil {
+			return "", err
+		}
+
+		if buf[i] == 0 {
+			return string(buf[:i]), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: string longer than %d bytes", ErrBadRequest, len(buf)-1)
+}
+
+// replySOCKS4 - sends the reply to a SOCKS4 request, the reply code of `res`
+// being mapped to granted or rejected. Only IPv4 bind addresses fit, others
+// being zeroed.
+//
+//	+----+----+----+----+----+----+----+----+
+//	| VN | CD | DSTPORT |      DSTIP        |
+//	+----+----+----+----+----+----+----+----+
+//	  1    1      2              4
+func replySOCKS4(conn net.Conn, res Socks5_Res) error {
+	reply := make([]byte, 8)
+
+	reply[1] = SOCKS4_GRANTED_reply
+	if res.Reply != SUCCEEDED_connReply {
+		reply[1] = SOCKS4_REJECTED_reply
+	}
+
+	if ip, err := netip.ParseAddr(res.BindAddr); err == nil && ip.Unmap().Is4() {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(res.BindPort))
+
+		v4 := ip.Unmap().As4()
+		copy(reply[4:], v4[:])
+	}
+
+	_, err := conn.Write(reply)
+	return err
+}
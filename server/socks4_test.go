@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// socks4Req - encodes a SOCKS4 CONNECT to `addr` from `user`
+func socks4Req(user string, addr *net.TCPAddr) []byte {
+	req := []byte{SOCKS4_VERSION, CONNECT_cmd}
+	req = binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+	req = append(req, addr.IP.To4()...)
+	req = append(req, user...)
+	return append(req, 0)
+}
+
+// socks4aReq - encodes a SOCKS4a CONNECT to `host`:`port` from `user`
+func socks4aReq(user, host string, port int) []byte {
+	req := socks4Req(user, &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: port})
+	req = append(req, host...)
+	return append(req, 0)
+}
+
+func TestSOCKS4UserIDIsNotAUser(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+	logger, logs := newTestLogger()
+
+	var mu sync.Mutex
+	var users, idents, tenantUsers []string
+
+	srv := startServer(t, Config{
+		AllowSOCKS4: true,
+		Logger:      logger,
+		Resolver:    &staticResolver{addrs: []string{"127.0.0.1"}},
+		Authorize: func(ctx context.Context, client ClientConn, user string, req Socks5_Req) error {
+			mu.Lock()
+			users = append(users, user)
+			idents = append(idents, Ident(ctx))
+			mu.Unlock()
+
+			return nil
+		},
+		TenantFor: func(sess *Session) string {
+			mu.Lock()
+			tenantUsers = append(tenantUsers, sess.User)
+			mu.Unlock()
+
+			return sess.Ident
+		},
+	})
+
+	for _, req := range [][]byte{
+		socks4Req("alice", echo),
+		socks4aReq("bob", "echo.example", echo.Port),
+	} {
+		conn := dialServer(t, srv)
+		write(t, conn, append(req, "ping"...))
+
+		if reply := readN(t, conn, 8); reply[0] != 0 || reply[1] != SOCKS4_GRANTED_reply {
+			t.Fatalf("reply = %v, want granted", reply)
+		}
+
+		if got := readN(t, conn, 4); string(got) != "ping" {
+			t.Fatalf("echo = %q, want ping", got)
+		}
+		conn.Close()
+	}
+
+	lines := accessLines(t, logs, 2)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the unauthenticated USERID never passes for a user
+	if !slices.Equal(users, []string{"", ""}) || !slices.Equal(tenantUsers, []string{"", ""}) {
+		t.Fatalf("Authorize saw users %q and TenantFor %q, want none", users, tenantUsers)
+	}
+
+	if !slices.Equal(idents, []string{"alice", "bob"}) {
+		t.Fatalf("Authorize saw idents %q, want the USERIDs alice and bob", idents)
+	}
+
+	for _, ident := range []string{"alice", "bob"} {
+		if !strings.Contains(strings.Join(lines, "\n"), "user=\"\" ident="+ident+" tenant="+ident) {
+			t.Errorf("access logs %q lack the ident %s apart from the user", lines, ident)
+		}
+	}
+}
+
+func TestSOCKS4Rejected(t *testing.T) {
+	echo := startEcho(t).(*net.TCPAddr)
+
+	for name, cfg := range map[string]Config{
+		"not allowed": {},
+		"auth required": {AllowSOCKS4: true, Authenticators: []Authenticator{UserPassAuthenticator{
+			Validate: func(user, pass string) bool { return true },
+		}}},
+	} {
+		srv := startServer(t, cfg)
+
+		conn := dialServer(t, srv)
+		write(t, conn, socks4Req("alice", echo))
+
+		if n, err := conn.Read(make([]byte, 8)); err == nil {
+			t.Fatalf("%s: read %d bytes, want the connection closed", name, n)
+		}
+	}
+}
+
+func TestSOCKS4DeniedReply(t *testing.T) {
+	srv := startServer(t, Config{AllowSOCKS4: true, Rules: &RuleSet{Deny: []string{"127.0.0.0/8"}}})
+
+	conn := dialServer(t, srv)
+	write(t, conn, socks4Req("alice", startEcho(t).(*net.TCPAddr)))
+
+	if reply := readN(t, conn, 8); reply[1] != SOCKS4_REJECTED_reply {
+		t.Fatalf("reply = %v, want rejected", reply)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// splice(2) flags, which the frozen syscall package lacks
+const (
+	spliceFMove     = 0x1
+	spliceFNonblock = 0x2
+)
+
+// spliceChunk - the most bytes moved through the pipe at once
+const spliceChunk = 1 << 20
+
+// spliceStream - copies src into dst through a pipe with splice(2), so that
+// the data never goes through userspace. Reads are recorded in `activity`
+// when it's set. `handled` is false when either side isn't a raw TCP
+// connection or splice isn't usable, in which case nothing was copied.
+func spliceStream(dst, src net.Conn, activity *atomic.Int64) (written int64, handled bool, err error) {
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	srcRaw, err := srcTCP.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	dstRaw, err := dstTCP.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	for {
+		// fill the pipe from the source socket
+		var moved int64
+		var spliceErr error
+
+		err := srcRaw.Read(func(fd uintptr) bool {
+			moved, spliceErr = syscall.Splice(int(fd), nil, pipe[1], nil, spliceChunk, spliceFMove|spliceFNonblock)
+			return spliceErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+
+		if err != nil {
+			// splice isn't supported for these sockets, let the caller copy
+			if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+				return 0, false, nil
+			}
+
+			return written, true, &readError{err}
+		}
+
+		if moved == 0 {
+			return written, true, nil
+		}
+
+		if activity != nil {
+			activity.Store(time.Now().UnixNano())
+		}
+
+		// drain the pipe into the destination socket
+		for moved > 0 {
+			var n int64
+
+			err := dstRaw.Write(func(fd uintptr) bool {
+				n, spliceErr = syscall.Splice(pipe[0], nil, int(fd), nil, int(moved), spliceFMove|spliceFNonblock)
+				return spliceErr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+
+			if err != nil {
+				return written, true, err
+			}
+
+			moved -= n
+			written += n
+		}
+	}
+}
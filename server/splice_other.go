@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// spliceStream - splice(2) is only available on linux, so the caller always
+// copies through userspace
+func spliceStream(dst, src net.Conn, activity *atomic.Int64) (written int64, handled bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// maxStatsDestinations - the most destinations counted one by one, the
+// tunnels of any further ones being counted under otherDestinations
+const maxStatsDestinations = 1024
+
+// otherDestinations - the destination the tunnels over the cap are counted
+// under
+const otherDestinations = "other"
+
+// Stats - a snapshot of the server's connections, as returned by StatsJSON
+type Stats struct {
+	// ActiveConns - the accepted connections handshaking or tunneling,
+	// leaving out those done tunneling and only being closed
+	ActiveConns int `json:"active_connections"`
+
+	// ActiveTunnels - the connections relaying data
+	ActiveTunnels int `json:"active_tunnels"`
+
+	// TotalConns - the connections accepted since the server started
+	TotalConns uint64 `json:"total_connections"`
+
+	// TotalTunnels - the tunnels finished since the server started
+	TotalTunnels uint64 `json:"total_tunnels"`
+
+	// BytesSent, BytesReceived - the bytes relayed by the finished tunnels,
+	// from clients to remotes and back
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	// Destinations - the finished tunnels per destination ("host:port"),
+	// for up to 1024 destinations, the others being counted under "other"
+	Destinations map[string]uint64 `json:"destinations"`
+}
+
+// serverStats - the running totals behind Stats
+type serverStats struct {
+	conns         atomic.Uint64
+	tunnels       atomic.Uint64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	mu    sync.Mutex
+	dests map[string]uint64
+}
+
+// recordTunnel - adds a finished tunnel to the totals
+func (st *serverStats) recordTunnel(dest string, result tunnelResult) {
+	st.tunnels.Add(1)
+	st.bytesSent.Add(result.sent)
+	st.bytesReceived.Add(result.received)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.dests == nil {
+		st.dests = make(map[string]uint64)
+	}
+
+	if _, ok := st.dests[dest]; !ok && len(st.dests) >= maxStatsDestinations {
+		dest = otherDestinations
+	}
+
+	st.dests[dest]++
+}
+
+// Stats - returns a snapshot of the server's connections
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		TotalConns:    s.stats.conns.Load(),
+		TotalTunnels:  s.stats.tunnels.Load(),
+		BytesSent:     s.stats.bytesSent.Load(),
+		BytesReceived: s.stats.bytesReceived.Load(),
+	}
+
+	s.mu.Lock()
+	for _, tracked := range s.conns {
+		if tracked.state == connDone {
+			continue
+		}
+
+		stats.ActiveConns++
+		if tracked.state == connActive {
+			stats.ActiveTunnels++
+		}
+	}
+	s.mu.Unlock()
+
+	s.stats.mu.Lock()
+	stats.Destinations = make(map[string]uint64, len(s.stats.dests))
+	for dest, n := range s.stats.dests {
+		stats.Destinations[dest] = n
+	}
+	s.stats.mu.Unlock()
+
+	return stats
+}
+
+// StatsJSON - returns the snapshot of Stats encoded as JSON, e.g. to serve
+// it from an admin endpoint
+func (s *Server) StatsJSON() ([]byte, error) {
+	return json.Marshal(s.Stats())
+}
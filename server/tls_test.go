@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedConfig - returns a TLS config serving a throwaway self-signed
+// certificate
+func selfSignedConfig(t testing.TB) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "socks5h test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSOCKSOverTLS(t *testing.T) {
+	echo := startEcho(t)
+	srv := startServer(t, Config{TLSConfig: selfSignedConfig(t)})
+
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	write(t, conn, []byte{SOCKS5H_VERSION, 1, NO_AUTHENTICATION_REQUIRED_method})
+	readN(t, conn, 2)
+
+	write(t, conn, ipReq(CONNECT_cmd, echo.(*net.TCPAddr)))
+	if reply := readReply(t, conn); reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("reply = %s", replyName(reply.rep))
+	}
+
+	write(t, conn, []byte("hi"))
+	if got := readN(t, conn, 2); string(got) != "hi" {
+		t.Fatalf("echo = %q, want hi", got)
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	metrics := newTestMetrics()
+	cfg := selfSignedConfig(t)
+	cfg.MinVersion = tls.VersionTLS10
+
+	srv := startServer(t, Config{TLSConfig: cfg, MinTLSVersion: tls.VersionTLS13, Metrics: metrics})
+
+	_, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		t.Fatal("TLS 1.2 client was accepted, want it rejected by MinTLSVersion")
+	}
+
+	waitFor(t, "tls_handshake failure", func() bool {
+		return metrics.count(MetricHandshakeFailed, "reason", "tls_handshake") == 1
+	})
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{
+		TLSConfig:           selfSignedConfig(t),
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+		Metrics:             metrics,
+	})
+
+	// a client connecting without ever sending its ClientHello
+	conn := dialServer(t, srv)
+
+	start := time.Now()
+	if n, _ := io.Copy(io.Discard, conn); n != 0 {
+		t.Fatalf("read %d bytes from a stalled TLS client", n)
+	}
+
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > time.Second {
+		t.Fatalf("closed after %v, want the 50ms timeout", waited)
+	}
+
+	waitFor(t, "tls_handshake failure", func() bool {
+		return metrics.count(MetricHandshakeFailed, "reason", failureTLSHandshake) == 1
+	})
+}
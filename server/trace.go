@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// traceLimit - caps the number of bytes recorded per traced connection, so
+// that long tunnels don't grow the trace without bound
+const traceLimit = 64 * 1024
+
+// traceConn - wraps a connection and records every byte read from and written
+// to it, in the order they were exchanged
+type traceConn struct {
+	wrappedConn
+
+	mu      sync.Mutex
+	size    int
+	records []traceRecord
+}
+
+// traceRecord - a chunk of bytes exchanged in one direction
+type traceRecord struct {
+	read bool
+	data []byte
+}
+
+// newTraceConn - starts tracing the connection
+func newTraceConn(conn net.Conn) *traceConn {
+	return &traceConn{wrappedConn: wrappedConn{conn}}
+}
+
+func (t *traceConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.record(true, b[:n])
+	return n, err
+}
+
+func (t *traceConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.record(false, b[:n])
+	return n, err
+}
+
+// record - appends the chunk to the trace, up to traceLimit bytes
+func (t *traceConn) record(read bool, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(b) == 0 || t.size >= traceLimit {
+		return
+	}
+
+	b = b[:min(len(b), traceLimit-t.size)]
+	t.size += len(b)
+	t.records = append(t.records, traceRecord{read: read, data: append([]byte(nil), b...)})
+}
+
+// Dump - renders the trace as a hex dump, one block per chunk with `<-` for
+// bytes read from the client and `->` for bytes written to it
+func (t *traceConn) Dump() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sb strings.Builder
+	for _, r := range t.records {
+		dir := "->"
+		if r.read {
+			dir = "<-"
+		}
+
+		fmt.Fprintf(&sb, "%s %d bytes\n%s", dir, len(r.data), hex.Dump(r.data))
+	}
+
+	if t.size >= traceLimit {
+		fmt.Fprintf(&sb, "... trace truncated at %d bytes\n", traceLimit)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebugTraceDumpsHandshake(t *testing.T) {
+	logger, logs := newTestLogger()
+	srv := startServer(t, Config{DebugTrace: true, Logger: logger})
+
+	conn := negotiate(t, srv)
+
+	// an unknown CMD fails the handshake, which dumps the trace
+	write(t, conn, []byte{SOCKS5H_VERSION, 0x09, RSV, IP_V4_addr, 127, 0, 0, 1, 0, 80})
+	waitForLog(t, logs, "connection trace")
+
+	out := logs.String()
+	for _, want := range []string{
+		// the methods read, then the method selection written
+		"<- 3 bytes", "05 01 00", "-> 2 bytes", "05 00",
+		// the request read
+		"<- 10 bytes", "05 09 00 01 7f 00 00 01  00 50",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("trace lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestTraceLimit(t *testing.T) {
+	trace := newTraceConn(nil)
+	trace.record(true, make([]byte, traceLimit+1))
+	trace.record(false, []byte("dropped"))
+
+	if dump := trace.Dump(); !strings.Contains(dump, "trace truncated") || strings.Contains(dump, "-> ") {
+		t.Fatalf("dump past the limit:\n%s", dump[len(dump)-200:])
+	}
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// StreamKind - a hint about the traffic of a tunnel, used to pick how its
+// data is copied
+type StreamKind int
+
+const (
+	// StreamDefault - copies through the standard 32KB buffer when the
+	// connections can't be spliced
+	StreamDefault StreamKind = iota
+
+	// StreamInteractive - small, latency sensitive writes (SSH, terminals).
+	// Copies through a small buffer, each read being written right away.
+	StreamInteractive
+
+	// StreamBulk - large transfers of already compressed or encrypted data.
+	// Copies through a large buffer when the connections can't be spliced.
+	StreamBulk
+)
+
+// Copy buffer sizes per StreamKind
+const (
+	interactiveBufferSize = 2 * 1024
+	bulkBufferSize        = 256 * 1024
+)
+
+// tunnelOptions - how a tunnel relays its data
+type tunnelOptions struct {
+	// idleTimeout - closes the tunnel once idle for this long, if non-zero
+	idleTimeout time.Duration
+
+	// kind - the copy strategy
+	kind StreamKind
+}
+
+// tunnelResult - how a tunnel went
+type tunnelResult struct {
+	// sent - bytes relayed from the client to the remote
+	sent int64
+
+	// received - bytes relayed from the remote to the client
+	received int64
+
+	// reason - why the tunnel ended, one of the tunnel end reasons
+	reason string
+
+	// duration - how long the tunnel lasted
+	duration time.Duration
+
+	readErr  error
+	writeErr error
+}
+
+// Tunnel end reasons
+const (
+	// endClientEOF - the client closed its side first
+	endClientEOF = "client_eof"
+
+	// endRemoteEOF - the remote closed its side first
+	endRemoteEOF = "remote_eof"
+
+	// endRemoteReset - the remote reset the connection, which ends the
+	// tunnel like an EOF rather than as an error
+	endRemoteReset = "remote_reset"
+
+	// endIdleTimeout - no data flowed for the idle timeout
+	endIdleTimeout = "idle_timeout"
+
+	// endClosed - the connections were closed locally, e.g. on shutdown
+	endClosed = "closed"
+
+	// endError - reading or writing either connection failed
+	endError = "error"
+)
+
+// tunnelEnd - records the first reason a tunnel ends for, as the other
+// direction usually ends as a consequence of it
+type tunnelEnd struct {
+	once   sync.Once
+	reason string
+}
+
+func (e *tunnelEnd) set(reason string) {
+	e.once.Do(func() { e.reason = reason })
+}
+
+// tunnel - relays data between the client and the remote until both
+// directions are done. A clean EOF on one side half-closes the other, while
+// an error in either direction tears down both connections. Errors caused by
+// the connections having been closed locally are not reported.
+//
+// With a non-zero idle timeout both connections are closed once no data
+// flowed in either direction for that long. Activity in one direction keeps
+// the whole tunnel alive.
+func tunnel(client, remote net.Conn, opts tunnelOptions) (res tunnelResult) {
+	start := time.Now()
+	idleTimeout := opts.idleTimeout
+	end := new(tunnelEnd)
+
+	var activity *atomic.Int64
+	if idleTimeout > 0 {
+		activity = new(atomic.Int64)
+		activity.Store(time.Now().UnixNano())
+
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go watchIdle(client, remote, activity, idleTimeout, end, stop)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		res.sent, res.writeErr = relay(remote, client, activity, opts.kind, end, endClientEOF)
+	}()
+	res.received, res.readErr = relay(client, remote, activity, opts.kind, end, endRemoteEOF)
+	<-done
+
+	remote.Close()
+	res.reason = end.reason
+	res.duration = time.Since(start)
+	return
+}
+
+// setNoDelay - sets TCP_NODELAY on the connection, if it has a TCP socket
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	if tc, ok := findConn[interface{ SetNoDelay(bool) error }](conn); ok {
+		return tc.SetNoDelay(noDelay)
+	}
+
+	return nil
+}
+
+// setBuffers - sets the receive and send buffer sizes of the connection, if it
+// has a TCP socket. Sizes that aren't positive are left alone.
+func setBuffers(conn net.Conn, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if tc, ok := findConn[interface{ SetReadBuffer(int) error }](conn); ok {
+			if err := tc.SetReadBuffer(readBuffer); err != nil {
+				return err
+			}
+		}
+	}
+
+	if writeBuffer > 0 {
+		if tc, ok := findConn[interface{ SetWriteBuffer(int) error }](conn); ok {
+			return tc.SetWriteBuffer(writeBuffer)
+		}
+	}
+
+	return nil
+}
+
+// watchIdle - closes both connections once the last activity is older than
+// `idleTimeout`, until `stop` is closed
+func watchIdle(client, remote net.Conn, activity *atomic.Int64, idleTimeout time.Duration, end *tunnelEnd, stop <-chan struct{}) {
+	ticker := time.NewTicker(max(idleTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, activity.Load())) >= idleTimeout {
+				end.set(endIdleTimeout)
+				client.Close()
+				remote.Close()
+				return
+			}
+		}
+	}
+}
+
+// relay - copies src into dst and closes the connections once done. Reads
+// are recorded in `activity` when it's set. Why the copy ended is recorded
+// in `end`, `eofReason` being the reason of a clean EOF on src. Returns the
+// bytes copied.
+func relay(dst, src net.Conn, activity *atomic.Int64, kind StreamKind, end *tunnelEnd, eofReason string) (int64, error) {
+	n, err := copyStream(dst, src, activity, kind)
+	if err != nil {
+		closed, reset := errors.Is(err, net.ErrClosed), isRemoteReset(err, eofReason)
+
+		switch {
+		case closed:
+			end.set(endClosed)
+		case reset:
+			end.set(endRemoteReset)
+		default:
+			end.set(endError)
+		}
+
+		dst.Close()
+		src.Close()
+
+		if closed || reset {
+			return n, nil
+		}
+
+		return n, err
+	}
+
+	end.set(eofReason)
+
+	// a connection that can't be half-closed is closed, so that the other
+	// side still sees the end of the stream
+	cw, ok := dst.(interface{ CloseWrite() error })
+	if !ok || errors.Is(cw.CloseWrite(), errors.ErrUnsupported) {
+		dst.Close()
+	}
+
+	return n, nil
+}
+
+// isRemoteReset - reports whether the error of a relay is the remote
+// resetting the connection: a reset met reading the remote, or writing to it
+// when the remote is the destination. `eofReason` tells the direction.
+func isRemoteReset(err error, eofReason string) bool {
+	var re *readError
+	fromSrc := errors.As(err, &re)
+
+	if eofReason == endRemoteEOF {
+		return fromSrc && errors.Is(err, syscall.ECONNRESET)
+	}
+
+	return !fromSrc && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE))
+}
+
+// readError - an error reading the source of a relay, telling it apart from
+// an error writing to its destination
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+// copyStream - copies src into dst with the strategy of the stream kind.
+// Unless the stream is interactive, two raw TCP connections are spliced
+// together in the kernel where supported. The bytes a prefixConn holds are
+// written first, so that the connection under it can still be spliced.
+func copyStream(dst, src net.Conn, activity *atomic.Int64, kind StreamKind) (int64, error) {
+	if p, ok := src.(*prefixConn); ok && len(p.prefix) > 0 {
+		if activity != nil {
+			activity.Store(time.Now().UnixNano())
+		}
+
+		n, err := dst.Write(p.prefix)
+		p.prefix = nil
+		if err != nil {
+			return int64(n), err
+		}
+
+		copied, err := copyStream(dst, p.Conn, activity, kind)
+		return int64(n) + copied, err
+	}
+
+	if kind != StreamInteractive {
+		if n, handled, err := spliceStream(dst, src, activity); handled {
+			return n, err
+		}
+	}
+
+	var r io.Reader = errorReader{src}
+	if activity != nil {
+		r = &activityReader{r: r, last: activity}
+	}
+
+	switch kind {
+	case StreamInteractive:
+		// hide ReadFrom/WriteTo so that the small buffer is always used
+		return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{r}, make([]byte, interactiveBufferSize))
+	case StreamBulk:
+		return io.CopyBuffer(dst, r, make([]byte, bulkBufferSize))
+	}
+
+	return io.Copy(dst, r)
+}
+
+// errorReader - wraps the errors of reading `r` other than io.EOF, which
+// io.Copy expects as is, in readError
+type errorReader struct {
+	r io.Reader
+}
+
+func (e errorReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	if err != nil && err != io.EOF {
+		err = &readError{err}
+	}
+
+	return n, err
+}
+
+// activityReader - stores the time of the last successful read in `last`
+type activityReader struct {
+	r    io.Reader
+	last *atomic.Int64
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.last.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
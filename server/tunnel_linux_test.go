@@ -0,0 +1,129 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// sockoptInt - reads an integer socket option of a connection
+func sockoptInt(t testing.TB, conn syscall.Conn, level, opt int) int {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("getting the raw conn: %v", err)
+	}
+
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatalf("control: %v", err)
+	}
+
+	if sockErr != nil {
+		t.Fatalf("getsockopt: %v", sockErr)
+	}
+
+	return value
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		noDelay *bool
+		want    int
+	}{
+		{name: "default", want: 1},
+		{name: "enabled", noDelay: func() *bool { b := true; return &b }(), want: 1},
+		{name: "disabled", noDelay: new(bool), want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var client ClientConn
+			var remote net.Conn
+
+			srv := startServer(t, Config{
+				TCPNoDelay: tc.noDelay,
+				Authorize: func(_ context.Context, c ClientConn, _ string, _ Socks5_Req) error {
+					mu.Lock()
+					client = c
+					mu.Unlock()
+					return nil
+				},
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+
+					mu.Lock()
+					remote = conn
+					mu.Unlock()
+					return conn, err
+				},
+			})
+
+			// a round trip guarantees the tunnel is set up
+			conn := connect(t, srv, startEcho(t))
+			write(t, conn, []byte("ping"))
+			readN(t, conn, 4)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for side, c := range map[string]syscall.Conn{"client": client, "remote": remote.(*net.TCPConn)} {
+				if got := sockoptInt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != tc.want {
+					t.Errorf("%s TCP_NODELAY = %d, want %d", side, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	const size = 32 << 10
+
+	var mu sync.Mutex
+	var client ClientConn
+	var remote net.Conn
+
+	srv := startServer(t, Config{
+		SocketReadBuffer:  size,
+		SocketWriteBuffer: size,
+		Authorize: func(_ context.Context, c ClientConn, _ string, _ Socks5_Req) error {
+			mu.Lock()
+			client = c
+			mu.Unlock()
+			return nil
+		},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+
+			mu.Lock()
+			remote = conn
+			mu.Unlock()
+			return conn, err
+		},
+	})
+
+	// a round trip guarantees the tunnel is set up
+	conn := connect(t, srv, startEcho(t))
+	write(t, conn, []byte("hi"))
+	readN(t, conn, 2)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Linux reports twice the size set, the rest being its bookkeeping
+	for side, c := range map[string]syscall.Conn{"client": client, "remote": remote.(*net.TCPConn)} {
+		for name, opt := range map[string]int{"SO_RCVBUF": syscall.SO_RCVBUF, "SO_SNDBUF": syscall.SO_SNDBUF} {
+			if got := sockoptInt(t, c, syscall.SOL_SOCKET, opt); got != 2*size {
+				t.Errorf("%s %s = %d, want %d", side, name, got, 2*size)
+			}
+		}
+	}
+}
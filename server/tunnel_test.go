@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair - returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestCopyStreamFlushesPrefix(t *testing.T) {
+	srcPeer, src := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+
+	go func() {
+		srcPeer.Write([]byte(" world"))
+		srcPeer.CloseWrite()
+	}()
+
+	n, err := copyStream(dst, &prefixConn{wrappedConn: wrappedConn{src}, prefix: []byte("hello")}, nil, StreamDefault)
+	if err != nil || n != 11 {
+		t.Fatalf("copyStream = %d, %v, want 11 bytes", n, err)
+	}
+	dst.CloseWrite()
+
+	if got, _ := io.ReadAll(dstPeer); string(got) != "hello world" {
+		t.Fatalf("copied %q, want the prefix then the stream", got)
+	}
+}
+
+func TestCheckRemoteKeepsTCPConn(t *testing.T) {
+	remote, peer := tcpPair(t)
+	peer.Write([]byte("220 ready"))
+
+	// the greeting has arrived by the time the remote is checked
+	time.Sleep(20 * time.Millisecond)
+
+	checked, err := checkRemote(remote, 0)
+	if err != nil {
+		t.Fatalf("checkRemote: %v", err)
+	}
+
+	// still spliceable, with the greeting left unread
+	if _, ok := checked.(*net.TCPConn); !ok {
+		t.Fatalf("checkRemote returned a %T, want the *net.TCPConn", checked)
+	}
+
+	if got := readN(t, checked, 9); string(got) != "220 ready" {
+		t.Fatalf("read %q, want the greeting", got)
+	}
+}
+
+func TestCheckRemoteDetectsClose(t *testing.T) {
+	remote, peer := tcpPair(t)
+	peer.Close()
+
+	if _, err := checkRemote(remote, time.Second); err == nil {
+		t.Fatal("closed remote passed the check")
+	}
+}
+
+func TestCheckRemoteDoesNotWait(t *testing.T) {
+	remote, _ := tcpPair(t)
+
+	start := time.Now()
+	if _, err := checkRemote(remote, 0); err != nil {
+		t.Fatalf("checkRemote: %v", err)
+	}
+
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Fatalf("checking a silent remote took %v", took)
+	}
+}
+
+func TestWrappedCloseWrite(t *testing.T) {
+	// half-closes through the wrappers
+	local, peer := tcpPair(t)
+	traced := newTraceConn(&prefixConn{wrappedConn: wrappedConn{local}})
+
+	if err := traced.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("peer read %v, want EOF", err)
+	}
+
+	// a connection that can't be half-closed is left open
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+
+	if err := newTraceConn(pipe).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CloseWrite of a pipe = %v, want ErrUnsupported", err)
+	}
+
+	go other.Read(make([]byte, 1))
+	if _, err := pipe.Write([]byte("x")); err != nil {
+		t.Fatalf("writing after the failed CloseWrite: %v", err)
+	}
+}
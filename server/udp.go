@@ -0,0 +1,463 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP relay defaults
+const (
+	// defaultUDPBufferSize - large enough for any UDP datagram
+	defaultUDPBufferSize = 64 * 1024
+
+	// defaultUDPMaxQueuedDatagrams - datagrams an association holds before
+	// dropping
+	defaultUDPMaxQueuedDatagrams = 64
+)
+
+// udpRelay - the relay socket of a UDP association. Closing it ends the
+// association and releases its slot.
+type udpRelay struct {
+	*net.UDPConn
+
+	once    sync.Once
+	release func()
+}
+
+// Close - closes the relay socket and releases the association
+func (r *udpRelay) Close() error {
+	r.once.Do(r.release)
+	return r.UDPConn.Close()
+}
+
+// udpAssociate - handles the UDP ASSOCIATE request by opening the relay
+// socket. In the reply, the BND.PORT and BND.ADDR fields indicate the port
+// number/address where the client MUST send UDP request messages to be
+// relayed.
+//
+// A UDP association terminates when the TCP connection that the UDP
+// ASSOCIATE request arrived on terminates.
+//
+// The relay is bound to the local IP the client reached the server on, so
+// that it is reachable the same way (e.g. through the same NAT), unless
+// `Config.UDPBindIP` overrides it.
+func (s *Server) udpAssociate(conn net.Conn, sess *Session, req Socks5_Req) (net.Conn, Socks5_Res, error) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("control connection isn't tcp")
+	}
+
+	if !s.udpSlots.acquire() {
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), errors.New("too many udp associations")
+	}
+
+	bindAddr := &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone}
+	if s.cfg.UDPBindIP != nil {
+		bindAddr = &net.UDPAddr{IP: s.cfg.UDPBindIP}
+	}
+
+	if s.cfg.PortAllocator != nil {
+		port, err := s.cfg.PortAllocator()
+		if err != nil {
+			s.udpSlots.release()
+			return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), fmt.Errorf("allocating port: %w", err)
+		}
+
+		bindAddr.Port = port
+	}
+
+	pc, err := net.ListenUDP(s.cfg.udpNetwork(), bindAddr)
+	if err != nil {
+		s.udpSlots.release()
+		return nil, newFailureRes(GENERAL_SOCKS_SERVER_FAILURE_connReply), err
+	}
+
+	relayAddr := pc.LocalAddr().(*net.UDPAddr)
+	res := newBindRes(&net.TCPAddr{IP: relayAddr.IP, Port: relayAddr.Port, Zone: relayAddr.Zone})
+
+	return &udpRelay{UDPConn: pc, release: s.udpSlots.release}, res, nil
+}
+
+// relayUDP - relays datagrams between the client and the destinations until
+// the control connection terminates.
+//
+// Each datagram from the client carries a UDP request header:
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+//
+// Fragmentation isn't supported, so datagrams whose FRAG field isn't X'00'
+// are dropped. The first datagram from the client's IP address fixes the
+// client's UDP address; only datagrams from it are relayed to destinations,
+// every other datagram is treated as a reply and is sent back to the client
+// with the header of its source.
+//
+// The destination of each client datagram is checked the way a CONNECT
+// destination is, see `datagramDst`, and resolved away from the loop
+// relaying replies. Denied datagrams are dropped.
+//
+// Datagrams are read into a bounded queue, so that the memory of an
+// association stays under `Config.UDPMaxQueuedDatagrams` buffers of
+// `Config.UDPBufferSize` bytes. Datagrams over the buffer size, or arriving
+// while the queue is full, are dropped.
+func (s *Server) relayUDP(ctx context.Context, conn net.Conn, relay *udpRelay, sess *Session) error {
+	defer relay.Close()
+
+	queueSize := s.cfg.udpMaxQueuedDatagrams()
+	queue := make(chan udpDatagram, queueSize)
+	outbound := make(chan udpDatagram, queueSize)
+	free := make(chan []byte, queueSize)
+
+	go s.readDatagrams(relay, queue, free)
+	go s.relayDatagrams(relay, addrIP(sess.ClientAddr), queue, outbound, free)
+	go s.sendDatagrams(ctx, conn, relay, sess, outbound, free)
+
+	// the association lives as long as the control connection
+	_, err := io.Copy(io.Discard, conn)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// udpDatagram - a datagram read by the relay socket
+type udpDatagram struct {
+	// buf - the buffer the datagram was read into, `data` being its start
+	buf  []byte
+	data []byte
+	from *net.UDPAddr
+}
+
+// readDatagrams - reads the datagrams of the relay socket into `queue` until
+// the socket is closed, reusing the buffers handed back on `free`
+func (s *Server) readDatagrams(relay *udpRelay, queue chan<- udpDatagram, free <-chan []byte) {
+	defer close(queue)
+
+	size := s.cfg.udpBufferSize()
+	metrics := s.cfg.metrics()
+
+	// the buffer of a dropped datagram is kept for the next read
+	var buf []byte
+
+	for {
+		if buf == nil {
+			select {
+			case buf = <-free:
+			default:
+				// one byte over the size tells datagrams that don't fit apart
+				buf = make([]byte, size+1)
+			}
+		}
+
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if n > size {
+			metrics.Count(MetricUDPDropped, 1, map[string]string{"reason": "too_large"})
+			continue
+		}
+
+		select {
+		case queue <- udpDatagram{buf: buf, data: buf[:n], from: from}:
+			buf = nil
+		default:
+			metrics.Count(MetricUDPDropped, 1, map[string]string{"reason": "queue_full"})
+		}
+	}
+}
+
+// relayDatagrams - sends the queued replies back to the client and hands the
+// client's datagrams to `outbound`, closing it once `queue` is
+func (s *Server) relayDatagrams(relay *udpRelay, clientIP net.IP, queue <-chan udpDatagram, outbound chan<- udpDatagram, free chan<- []byte) {
+	defer close(outbound)
+
+	var client *net.UDPAddr
+
+	for d := range queue {
+		from := d.from
+
+		if client == nil && from.IP.Equal(clientIP) {
+			client = from
+		}
+
+		if client != nil && client.IP.Equal(from.IP) && client.Port == from.Port {
+			select {
+			case outbound <- d:
+				continue
+			default:
+				s.cfg.metrics().Count(MetricUDPDropped, 1, map[string]string{"reason": "queue_full"})
+			}
+		} else if client != nil {
+			relay.WriteToUDP(append(udpHeader(from), d.data...), client)
+		}
+
+		recycleDatagram(free, d)
+	}
+}
+
+// sendDatagrams - sends the client's datagrams to their destinations, once
+// checked and resolved, dropping the others
+func (s *Server) sendDatagrams(ctx context.Context, conn net.Conn, relay *udpRelay, sess *Session, outbound <-chan udpDatagram, free chan<- []byte) {
+	dsts := make(map[string]udpDestination)
+
+	for d := range outbound {
+		req, data, err := parseUDPRequest(d.data)
+		if err != nil {
+			s.cfg.metrics().Count(MetricUDPDropped, 1, map[string]string{"reason": "malformed"})
+			recycleDatagram(free, d)
+			continue
+		}
+
+		dst, err := s.datagramDst(ctx, conn, relay, sess, req, dsts)
+		if err != nil {
+			reason := "unresolved"
+			if errors.Is(err, errDatagramDenied) {
+				reason = "denied"
+			}
+
+			s.cfg.metrics().Count(MetricUDPDropped, 1, map[string]string{"reason": reason})
+			s.logger(ctx).Debug("dropping datagram", "client", sess.ClientAddr, "dst", req.FullAddr(), "err", err)
+		} else {
+			relay.WriteToUDP(data, dst)
+		}
+
+		recycleDatagram(free, d)
+	}
+}
+
+// recycleDatagram - hands the buffer of a datagram back for the next read,
+// or lets it go if enough are waiting
+func recycleDatagram(free chan<- []byte, d udpDatagram) {
+	select {
+	case free <- d.buf:
+	default:
+	}
+}
+
+// errDatagramDenied - the destination of a client datagram isn't allowed
+var errDatagramDenied = errors.New("datagram destination denied")
+
+// UDP destination cache bounds
+const (
+	// udpDestinationTTL - how long the checked and resolved destination of a
+	// datagram is reused for, so that rule updates and DNS changes still
+	// reach long-lived associations
+	udpDestinationTTL = 30 * time.Second
+
+	// udpMaxDestinations - the destinations an association remembers before
+	// starting over
+	udpMaxDestinations = 256
+)
+
+// udpDestination - the outcome of checking and resolving a datagram
+// destination, cached per association
+type udpDestination struct {
+	addr    *net.UDPAddr
+	err     error
+	expires time.Time
+}
+
+// datagramDst - returns the address to send a client datagram for the
+// destination of `req` to, checking and resolving it only once in a while
+// per association thanks to `dsts`
+func (s *Server) datagramDst(ctx context.Context, conn net.Conn, relay *udpRelay, sess *Session, req Socks5_Req, dsts map[string]udpDestination) (*net.UDPAddr, error) {
+	key := req.FullAddr()
+	now := time.Now()
+
+	if dst, ok := dsts[key]; ok && now.Before(dst.expires) {
+		return dst.addr, dst.err
+	}
+
+	if len(dsts) >= udpMaxDestinations {
+		clear(dsts)
+	}
+
+	addr, err := s.resolveDatagramDst(ctx, conn, relay, sess, req)
+	dsts[key] = udpDestination{addr: addr, err: err, expires: now.Add(udpDestinationTTL)}
+
+	return addr, err
+}
+
+// resolveDatagramDst - checks the destination of a client datagram against
+// `Config.RequireHostnames`, `Config.Authorize`, the RuleSet and
+// `Config.Policy` as a CONNECT destination would be, then resolves it with
+// the configured Resolver. Destinations resolving to the server itself, its
+// listeners or the relay, are denied. `req` is the datagram's destination
+// under the UDP_ASSOCIATE_cmd command.
+func (s *Server) resolveDatagramDst(ctx context.Context, conn net.Conn, relay *udpRelay, sess *Session, req Socks5_Req) (*net.UDPAddr, error) {
+	if s.cfg.RequireHostnames && req.AType != DOMAINNAME_addr {
+		return nil, fmt.Errorf("%w: IP literal destinations aren't allowed", errDatagramDenied)
+	}
+
+	if s.cfg.Authorize != nil {
+		if err := s.cfg.Authorize(ctx, newClientConn(conn), sess.User, req); err != nil {
+			s.requestDenied(ctx, sess, req, denyAuthorize, err)
+			return nil, fmt.Errorf("%w: %w", errDatagramDenied, err)
+		}
+	}
+
+	// the RuleSet only evaluates CONNECT requests as a Policy, the datagram
+	// destinations are matched the same way
+	if err := s.rules.Load().check(req); err != nil {
+		s.requestDenied(ctx, sess, req, denyRules, err)
+		return nil, fmt.Errorf("%w: %w", errDatagramDenied, err)
+	}
+
+	if s.cfg.Policy != nil {
+		decision, err := s.cfg.Policy.Evaluate(ctx, sess, req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: evaluating policy: %w", errDatagramDenied, err)
+		}
+
+		if !decision.Allow {
+			s.requestDenied(ctx, sess, req, denyPolicy, decision.err())
+			return nil, fmt.Errorf("%w: %w", errDatagramDenied, decision.err())
+		}
+	}
+
+	network := s.datagramNetwork(relay)
+
+	// IP literals need no resolving
+	addrs := []string{req.AddrStr()}
+
+	if req.AType == DOMAINNAME_addr {
+		if timeout := s.cfg.dialTimeout(req); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		var err error
+		if addrs, err = s.lookupHost(withLookupNetwork(ctx, network), req.AddrStr()); err != nil {
+			return nil, err
+		}
+	}
+
+	addrs = filterFamily(addrs, network)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no %s addresses", req.AddrStr(), network)
+	}
+
+	dst := &net.UDPAddr{IP: net.ParseIP(addrs[0]), Port: req.PortNum()}
+	if dst.IP == nil {
+		return nil, fmt.Errorf("%s resolves to %q which isn't an IP", req.AddrStr(), addrs[0])
+	}
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	toRelay := dst.Port == relayAddr.Port &&
+		(dst.IP.Equal(relayAddr.IP) || (relayAddr.IP.IsUnspecified() && isLocalIP(dst.IP)))
+
+	if toRelay || s.isSelf(dst.IP, dst.Port) {
+		err := fmt.Errorf("%w: %s resolves to %s", ErrLoop, req.AddrStr(), dst)
+		s.requestDenied(ctx, sess, req, denyLoop, err)
+		return nil, fmt.Errorf("%w: %w", errDatagramDenied, err)
+	}
+
+	return dst, nil
+}
+
+// datagramNetwork - returns the TCP network matching the address families
+// the relay can send to, for resolving and filtering datagram destinations:
+// `Config.OutboundNetwork` when set, otherwise the family of the relay's
+// bound IP, either when it's unspecified
+func (s *Server) datagramNetwork(relay *udpRelay) string {
+	if len(s.cfg.OutboundNetwork) > 0 {
+		return s.cfg.OutboundNetwork
+	}
+
+	ip := relay.LocalAddr().(*net.UDPAddr).IP
+	switch {
+	case ip.IsUnspecified():
+		return TCP
+	case ip.To4() != nil:
+		return TCP_V4
+	}
+
+	return TCP_V6
+}
+
+// parseUDPRequest - parses the UDP request header of a client datagram and
+// returns its destination, as a request of the UDP_ASSOCIATE_cmd command,
+// along with the payload
+func parseUDPRequest(b []byte) (Socks5_Req, []byte, error) {
+	if len(b) < 4 {
+		return Socks5_Req{}, nil, errors.New("udp request header too short")
+	}
+
+	if b[2] != 0x00 {
+		return Socks5_Req{}, nil, errors.New("udp fragmentation isn't supported")
+	}
+
+	var addr, rest []byte
+
+	switch b[3] {
+	case IP_V4_addr:
+		if len(b) < 4+4+2 {
+			return Socks5_Req{}, nil, errors.New("udp request ipv4 too short")
+		}
+		addr, rest = b[4:8], b[8:]
+	case IP_V6_addr:
+		if len(b) < 4+16+2 {
+			return Socks5_Req{}, nil, errors.New("udp request ipv6 too short")
+		}
+		addr, rest = b[4:20], b[20:]
+	case DOMAINNAME_addr:
+		if len(b) < 5 || len(b) < 5+int(b[4])+2 {
+			return Socks5_Req{}, nil, errors.New("udp request domain name too short")
+		}
+		addr, rest = b[5:5+int(b[4])], b[5+int(b[4]):]
+	default:
+		return Socks5_Req{}, nil, errors.New("invalid atyp provided")
+	}
+
+	req := Socks5_Req{
+		Version: SOCKS5H_VERSION,
+		Cmd:     UDP_ASSOCIATE_cmd,
+		AType:   b[3],
+		// copied, as the datagram buffer gets reused
+		DstAddr: bytes.Clone(addr),
+		DstPort: bytes.Clone(rest[:2]),
+	}
+
+	return req, rest[2:], nil
+}
+
+// udpHeader - builds the UDP request header carrying `from` as the address
+func udpHeader(from *net.UDPAddr) []byte {
+	header := []byte{RSV, RSV, 0x00}
+
+	if v4 := from.IP.To4(); v4 != nil {
+		header = append(header, IP_V4_addr)
+		header = append(header, v4...)
+	} else {
+		header = append(header, IP_V6_addr)
+		header = append(header, from.IP.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(header, uint16(from.Port))
+}
+
+// addrIP - returns the IP of a TCP or UDP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	return nil
+}
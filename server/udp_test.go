@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho - starts a UDP server echoing back the datagrams it reads,
+// until the test ends
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			pc.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// associate - negotiates a UDP association, returning the control connection
+// and a UDP socket connected to the relay
+func associate(t *testing.T, srv *Server) (net.Conn, *net.UDPConn) {
+	t.Helper()
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv4zero}))
+
+	reply := readReply(t, conn)
+	if reply.rep != SUCCEEDED_connReply {
+		t.Fatalf("UDP ASSOCIATE reply = %s", replyName(reply.rep))
+	}
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(reply.addr), Port: reply.port})
+	if err != nil {
+		t.Fatalf("dialing the relay: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return conn, client
+}
+
+// datagram - encodes a client datagram to `dst`
+func datagram(dst *net.UDPAddr, data string) []byte {
+	return append(udpHeader(dst), data...)
+}
+
+// readDatagram - reads a datagram relayed back to the client, or nil if
+// none arrives within `wait`
+func readDatagram(t *testing.T, client *net.UDPConn, wait time.Duration) []byte {
+	t.Helper()
+
+	client.SetReadDeadline(time.Now().Add(wait))
+
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		return nil
+	}
+
+	return buf[:n]
+}
+
+// domainDatagram - encodes a client datagram to `host`:`port`
+func domainDatagram(host string, port int, data string) []byte {
+	b := []byte{RSV, RSV, 0x00, DOMAINNAME_addr, byte(len(host))}
+	b = append(b, host...)
+	b = append(b, byte(port>>8), byte(port))
+	return append(b, data...)
+}
+
+func TestUDPDeniedByRules(t *testing.T) {
+	metrics := newTestMetrics()
+	echo := startUDPEcho(t)
+	srv := startServer(t, Config{Metrics: metrics, Rules: &RuleSet{Deny: []string{"127.0.0.0/8"}}})
+	_, client := associate(t, srv)
+
+	client.Write(datagram(echo, "ping"))
+	waitFor(t, "denied drop", func() bool {
+		return metrics.count(MetricUDPDropped, "reason", "denied") == 1
+	})
+
+	if got := readDatagram(t, client, 50*time.Millisecond); got != nil {
+		t.Fatalf("denied datagram was relayed, got %v back", got)
+	}
+
+	if got := metrics.count(MetricRequestDenied, "reason", denyRules); got != 1 {
+		t.Fatalf("%s{reason=%s} = %d, want 1", MetricRequestDenied, denyRules, got)
+	}
+}
+
+func TestUDPDeniedByChecks(t *testing.T) {
+	echo := startUDPEcho(t)
+
+	for name, cfg := range map[string]Config{
+		"policy":            {Policy: datagramPolicy{}},
+		"require hostnames": {RequireHostnames: true},
+		"authorize": {Authorize: func(ctx context.Context, client ClientConn, user string, req Socks5_Req) error {
+			if req.Cmd == UDP_ASSOCIATE_cmd && req.PortNum() == echo.Port {
+				return errors.New("no")
+			}
+			return nil
+		}},
+	} {
+		metrics := newTestMetrics()
+		cfg.Metrics = metrics
+
+		srv := startServer(t, cfg)
+		_, client := associate(t, srv)
+
+		client.Write(datagram(echo, "ping"))
+		waitFor(t, name+" drop", func() bool {
+			return metrics.count(MetricUDPDropped, "reason", "denied") == 1
+		})
+	}
+}
+
+// datagramPolicy - allows UDP associations but denies the destinations of
+// their datagrams
+type datagramPolicy struct{}
+
+func (datagramPolicy) Evaluate(ctx context.Context, sess *Session, req Socks5_Req) (Decision, error) {
+	return Decision{Allow: req.PortNum() == 0}, nil
+}
+
+func TestUDPResolvesWithResolver(t *testing.T) {
+	echo := startUDPEcho(t)
+	resolver := &staticResolver{addrs: []string{"::1", "127.0.0.1"}}
+	srv := startServer(t, Config{Resolver: resolver})
+	_, client := associate(t, srv)
+
+	client.Write(domainDatagram("echo.example", echo.Port, "ping"))
+
+	// the reply carries the address it came from
+	if got, want := readDatagram(t, client, testTimeout), datagram(echo, "ping"); !bytes.Equal(got, want) {
+		t.Fatalf("relayed back %v, want %v", got, want)
+	}
+
+	// the relay is bound to an IPv4 address, so only A records are asked for
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+
+	if len(resolver.networks) != 1 || resolver.networks[0] != "ip4" {
+		t.Fatalf("lookup networks = %q, want a single ip4 lookup", resolver.networks)
+	}
+}
+
+func TestUDPToRelayIsLoop(t *testing.T) {
+	metrics := newTestMetrics()
+	srv := startServer(t, Config{Metrics: metrics})
+	_, client := associate(t, srv)
+
+	client.Write(datagram(client.RemoteAddr().(*net.UDPAddr), "ping"))
+	waitFor(t, "loop drop", func() bool {
+		return metrics.count(MetricRequestDenied, "reason", denyLoop) == 1
+	})
+}
+
+func TestUDPRelay(t *testing.T) {
+	echo := startUDPEcho(t)
+	srv := startServer(t, Config{})
+	_, client := associate(t, srv)
+
+	client.Write(datagram(echo, "ping"))
+
+	got := readDatagram(t, client, testTimeout)
+	if want := datagram(echo, "ping"); !bytes.Equal(got, want) {
+		t.Fatalf("relayed back %v, want %v", got, want)
+	}
+}
+
+func TestUDPAssociationLimit(t *testing.T) {
+	srv := startServer(t, Config{MaxUDPAssociations: 1})
+	associate(t, srv)
+
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv4zero}))
+
+	if reply := readReply(t, conn); reply.rep != GENERAL_SOCKS_SERVER_FAILURE_connReply {
+		t.Fatalf("second association reply = %s, want general failure", replyName(reply.rep))
+	}
+}
+
+func TestUDPNetwork(t *testing.T) {
+	requireIPv6(t)
+
+	srv := startServer(t, Config{Addr: "[::1]:0", UDPNetwork: UDP_V6})
+	conn := negotiate(t, srv)
+	write(t, conn, ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv6unspecified}))
+
+	reply := readReply(t, conn)
+	if reply.rep != SUCCEEDED_connReply || net.ParseIP(reply.addr).To4() != nil {
+		t.Fatalf("UDP ASSOCIATE reply = %s on %s, want succeeded on IPv6", replyName(reply.rep), reply.addr)
+	}
+
+	srv = startServer(t, Config{UDPNetwork: "udp5"})
+	conn = negotiate(t, srv)
+	write(t, conn, ipReq(UDP_ASSOCIATE_cmd, &net.TCPAddr{IP: net.IPv4zero}))
+
+	if reply := readReply(t, conn); reply.rep != GENERAL_SOCKS_SERVER_FAILURE_connReply {
+		t.Fatalf("UDP ASSOCIATE reply with an invalid network = %s, want general failure", replyName(reply.rep))
+	}
+}
+
+func TestUDPDropsOversizedDatagrams(t *testing.T) {
+	metrics := newTestMetrics()
+	echo := startUDPEcho(t)
+	srv := startServer(t, Config{UDPBufferSize: 64, Metrics: metrics})
+	_, client := associate(t, srv)
+
+	client.Write(datagram(echo, string(make([]byte, 100))))
+	waitFor(t, "too_large drop", func() bool {
+		return metrics.count(MetricUDPDropped, "reason", "too_large") == 1
+	})
+}
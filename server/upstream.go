@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialHTTPProxy - dials the destination of the request through the HTTP
+// proxy at `proxy` with an HTTP CONNECT. The destination's domain name is
+// passed on as is, so the proxy resolves it. On failure the reply code to
+// send is returned.
+func (s *Server) dialHTTPProxy(ctx context.Context, proxy *url.URL, req Socks5_Req) (net.Conn, byte, error) {
+	if proxy.Scheme != "http" {
+		return nil, GENERAL_SOCKS_SERVER_FAILURE_connReply, fmt.Errorf("unsupported upstream proxy scheme %q", proxy.Scheme)
+	}
+
+	proxyAddr := proxy.Host
+	if len(proxy.Port()) == 0 {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+
+	upstream, err := s.cfg.dial(ctx, TCP, proxyAddr)
+	if err != nil {
+		return nil, dialErrorReply(err), fmt.Errorf("dial upstream proxy: %w", err)
+	}
+
+	// the handshake with the proxy is bound by the dial timeout too, so
+	// that a proxy that never answers can't hold the request
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+
+	if err := upstream.SetDeadline(deadline); err != nil {
+		upstream.Close()
+		return nil, GENERAL_SOCKS_SERVER_FAILURE_connReply, err
+	}
+
+	remote, reply, err := httpConnect(upstream, proxy, req)
+	if err != nil {
+		upstream.Close()
+		return nil, reply, fmt.Errorf("upstream proxy %s: %w", proxyAddr, err)
+	}
+
+	if err := upstream.SetDeadline(time.Time{}); err != nil {
+		upstream.Close()
+		return nil, GENERAL_SOCKS_SERVER_FAILURE_connReply, err
+	}
+
+	return remote, SUCCEEDED_connReply, nil
+}
+
+// httpConnect - asks the proxy on `upstream` to open a tunnel to the
+// destination of the request and reads its response. Returns the connection
+// to tunnel over, which keeps any byte the proxy sent past the response.
+func httpConnect(upstream net.Conn, proxy *url.URL, req Socks5_Req) (net.Conn, byte, error) {
+	target := req.FullAddr()
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		connect.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := connect.Write(upstream); err != nil {
+		return nil, dialErrorReply(err), err
+	}
+
+	br := bufio.NewReader(upstream)
+	res, err := http.ReadResponse(br, connect)
+	if err != nil {
+		return nil, dialErrorReply(err), err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, httpConnectReply(res.StatusCode), fmt.Errorf("CONNECT %s: %s", target, res.Status)
+	}
+
+	if n := br.Buffered(); n > 0 {
+		prefix, _ := br.Peek(n)
+		return &prefixConn{wrappedConn: wrappedConn{upstream}, prefix: prefix}, SUCCEEDED_connReply, nil
+	}
+
+	return upstream, SUCCEEDED_connReply, nil
+}
+
+// httpConnectReply - maps the status of a failed HTTP CONNECT to a reply
+// code
+func httpConnectReply(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return CONNECTION_NOT_ALLOWED_BY_RULESET_connReply
+	case http.StatusBadGateway, http.StatusNotFound:
+		return HOST_UNREACHABLE_connReply
+	case http.StatusGatewayTimeout:
+		return TTL_EXPIRED_connReply
+	}
+
+	return GENERAL_SOCKS_SERVER_FAILURE_connReply
+}